@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/rakoo/mmas/pkg/admin"
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+// History lists the stored dictionaries, newest first.
+func (bh *bodyHandler) History() ([]store.Entry, error) {
+	return bh.store.List()
+}
+
+// Current is the hash of the advertised dictionary, or nil.
+func (bh *bodyHandler) Current() []byte {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	if bh.current == nil {
+		return nil
+	}
+	return bh.current.Hash
+}
+
+func (bh *bodyHandler) Pinned() bool {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	return bh.pinned
+}
+
+// SetPinned stops or resumes automatic rotation of the dictionary.
+func (bh *bodyHandler) SetPinned(pinned bool) error {
+	var err error
+	if pinned {
+		current := bh.Current()
+		if current == nil {
+			return admin.ErrNoCurrent
+		}
+		err = bh.savePinned(current)
+	} else {
+		_, err = bh.db.Exec(`DELETE FROM pinned`)
+	}
+	if err != nil {
+		return err
+	}
+
+	bh.mu.Lock()
+	bh.pinned = pinned
+	bh.mu.Unlock()
+	return nil
+}
+
+// Promote advertises a stored dictionary and pins it.
+func (bh *bodyHandler) Promote(hash []byte) error {
+	e, err := bh.store.Entry(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := bh.publish(&dictVersion{Entry: e}); err != nil {
+		return err
+	}
+	// Only pinned once published, so that a failure leaves rotation on
+	if err := bh.SetPinned(true); err != nil {
+		return err
+	}
+
+	log.Printf("Promoted dict %s\n", e.Name())
+	return nil
+}
+
+func (bh *bodyHandler) savePinned(hash []byte) error {
+	_, err := bh.db.Exec(`INSERT OR REPLACE INTO pinned (id, hash) VALUES (0, ?)`, hash)
+	return err
+}
+
+// loadPinned returns the hash of the pinned dictionary, or nil.
+func (bh *bodyHandler) loadPinned() ([]byte, error) {
+	var hash []byte
+	err := bh.db.QueryRow(`SELECT hash FROM pinned WHERE id = 0`).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return hash, err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/clients"
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+// An archive is a gzipped tar file with the following members:
+//
+//	chunks.jsonl          one archivedChunk per line
+//	dicts/<name>.json     metadata of a stored dictionary
+//	dicts/<name>.hdr      its header
+//	dicts/<name>.dict     its content
+const (
+	archiveChunks = "chunks.jsonl"
+	archiveDicts  = "dicts/"
+)
+
+type archivedChunk struct {
+	Content []byte
+	Hash    []byte
+	Count   int64
+
+	// Number of distinct clients the chunk was sent to; who they are is
+	// not archived
+	Clients int64
+}
+
+type archivedMeta struct {
+	Domain  string
+	Path    string
+	Ports   []int `json:",omitempty"`
+	Created time.Time
+	MaxAge  int64 // in seconds
+}
+
+// runCommand runs the export and import subcommands:
+//
+//	mmas export <archive>
+//	mmas import <archive>
+//
+// They are for the forward proxy only. The reverse proxy keeps everything
+// an origin learned in the directory of the origin, which is moved as is.
+func (bh *bodyHandler) runCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: mmas [-config <file>] export|import <archive>")
+	}
+
+	switch args[0] {
+	case "export":
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		if err := bh.exportArchive(f); err != nil {
+			f.Close()
+			os.Remove(args[1])
+			return err
+		}
+		return f.Close()
+	case "import":
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return bh.importArchive(f)
+	default:
+		return fmt.Errorf("Unknown command %q", args[0])
+	}
+}
+
+func (bh *bodyHandler) exportArchive(w io.Writer) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	// The chunks table can be big, so go through a temporary file to
+	// know its size before writing the tar header
+	tmp, err := ioutil.TempFile("", "mmas-chunks")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	rows, err := bh.db.Query(`SELECT content, hash, count, ` + clients.Count + ` FROM chunks`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(tmp)
+	var nChunks int
+	for rows.Next() {
+		var c archivedChunk
+		if err := rows.Scan(&c.Content, &c.Hash, &c.Count, &c.Clients); err != nil {
+			return err
+		}
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		nChunks++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if err := writeArchiveHeader(tw, archiveChunks, size); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return err
+	}
+
+	entries, err := bh.store.List()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		d, err := bh.store.Get(e.Hash)
+		if err != nil {
+			return err
+		}
+		meta, err := json.Marshal(archivedMeta{
+			Domain:  d.Domain,
+			Path:    d.Path,
+			Ports:   d.Ports,
+			Created: d.Created,
+			MaxAge:  int64(d.MaxAge.Seconds()),
+		})
+		if err != nil {
+			return err
+		}
+
+		prefix := archiveDicts + d.Name()
+		for _, member := range []struct {
+			name string
+			data []byte
+		}{
+			{prefix + ".json", meta},
+			{prefix + ".hdr", d.Header},
+			{prefix + ".dict", d.Content},
+		} {
+			if err := writeArchiveHeader(tw, member.name, int64(len(member.data))); err != nil {
+				return err
+			}
+			if _, err := tw.Write(member.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d chunks and %d dicts\n", nChunks, len(entries))
+	return nil
+}
+
+func writeArchiveHeader(tw *tar.Writer, name string, size int64) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+}
+
+// importArchive merges an archive into this instance. Counts of chunks
+// that are already known are added up. The clients the chunks were sent
+// to are only archived as a number: they are counted here as that many
+// anonymous clients, told apart from the local ones.
+func (bh *bodyHandler) importArchive(r io.Reader) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	type pending struct {
+		meta, header, content []byte
+	}
+	dicts := make(map[string]*pending)
+	var nChunks int
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name == archiveChunks {
+			nChunks, err = bh.importChunks(tr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(hdr.Name, archiveDicts) {
+			log.Println("Skipping unknown archive member", hdr.Name)
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		base := path.Base(hdr.Name)
+		ext := path.Ext(base)
+		name := strings.TrimSuffix(base, ext)
+		if dicts[name] == nil {
+			dicts[name] = &pending{}
+		}
+		switch ext {
+		case ".json":
+			dicts[name].meta = data
+		case ".hdr":
+			dicts[name].header = data
+		case ".dict":
+			dicts[name].content = data
+		}
+	}
+
+	for name, p := range dicts {
+		if p.meta == nil || p.header == nil || p.content == nil {
+			return fmt.Errorf("Incomplete dict %s in archive", name)
+		}
+		var m archivedMeta
+		if err := json.Unmarshal(p.meta, &m); err != nil {
+			return err
+		}
+		e, err := bh.store.Put(p.header, p.content, store.Meta{
+			Domain:  m.Domain,
+			Path:    m.Path,
+			Ports:   m.Ports,
+			Created: m.Created,
+			MaxAge:  time.Duration(m.MaxAge) * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		if e.Name() != name {
+			bh.store.Delete(e.Hash)
+			return fmt.Errorf("Dict %s in archive is really %s", name, e.Name())
+		}
+	}
+
+	log.Printf("Imported %d chunks and %d dicts\n", nChunks, len(dicts))
+	return nil
+}
+
+func (bh *bodyHandler) importChunks(r io.Reader) (int, error) {
+	tx, err := bh.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`
+	INSERT OR REPLACE INTO chunks VALUES (
+		?,
+		?,
+		COALESCE((SELECT count FROM chunks WHERE hash = ?), 0) + ?
+	);`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	clientStmt, err := tx.Prepare(clients.Add)
+	if err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return 0, err
+	}
+	minClients := bh.config().Privacy.MinClients
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var c archivedChunk
+		err := dec.Decode(&c)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			_, err = stmt.Exec(c.Content, c.Hash, c.Hash, c.Count)
+		}
+		// Clients are only recorded until there are enough of them
+		for i := 0; err == nil && i < int(c.Clients) && i < minClients; i++ {
+			_, err = clientStmt.Exec(c.Hash, clients.Imported(i), c.Hash, minClients)
+		}
+		if err != nil {
+			clientStmt.Close()
+			stmt.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		n++
+	}
+
+	if err := clientStmt.Close(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
@@ -3,72 +3,187 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
 	"encoding/hex"
-	"io"
+	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/textproto"
 	"net/url"
-	"os"
-	"os/exec"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/elazarl/goproxy"
 	"github.com/kr/pretty"
+	"github.com/rakoo/mmas/pkg/coding"
+	"github.com/rakoo/mmas/pkg/config"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
+	"github.com/rakoo/mmas/pkg/vcdiff"
 )
 
 var (
-	dictName string
+	dicts *store.Store
 )
 
-func downloadDict(url string) {
-	log.Println("Getting dict", path.Base(url))
-	resp, err := http.Get(url)
+// scoped returns the dictionaries that may be used for u, newest first.
+// Expired dictionaries are removed on the way.
+func scoped(u *url.URL) []store.Entry {
+	entries, err := dicts.List()
+	if err != nil {
+		log.Println("Error listing dicts:", err)
+		return nil
+	}
+
+	now := time.Now()
+	inScope := make([]store.Entry, 0, len(entries))
+	for _, e := range entries {
+		if now.After(e.Expires()) {
+			log.Println("Dropping expired dict", e.Name())
+			dicts.Delete(e.Hash)
+			continue
+		}
+		if sdch.InScope(u, e.Domain, e.Path, e.Ports) {
+			inScope = append(inScope, e)
+		}
+	}
+	return inScope
+}
+
+// downloadDict fetches a dictionary announced in a response to referrer,
+// and keeps it only if referrer was allowed to announce it.
+func downloadDict(dictUrl string, referrer *url.URL) {
+	log.Println("Getting dict", path.Base(dictUrl))
+	req, err := http.NewRequest("GET", dictUrl, nil)
 	if err != nil {
 		log.Println("Error getting dict:", err)
 		return
 	}
-	f, err := os.Create(path.Join("dicts", path.Base(url)))
+	// The server may send the new dictionary as a delta against ours
+	if have := scoped(referrer); len(have) > 0 {
+		req.Header.Set(store.HaveHeader, have[0].Name())
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println(err)
+		log.Println("Error getting dict:", err)
 		return
 	}
-	defer f.Close()
+	defer resp.Body.Close()
 
-	buffered := bufio.NewReader(resp.Body)
-	tr := textproto.NewReader(buffered)
-	sdchHeader, err := tr.ReadMIMEHeader()
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+
+	if base := resp.Header.Get(store.DeltaBaseHeader); base != "" {
+		deltaLen := len(body)
+		body, err = dicts.Undelta(body, base)
+		if err != nil {
+			log.Println("Error applying dict delta:", err)
+			return
+		}
+		log.Printf("Rebuilt dict from a %d bytes delta against %s\n", deltaLen, base)
+	}
+
+	sdchHeader, header, content, err := sdch.ParseDictionary(body)
+	if err != nil {
+		log.Println("Invalid dict:", err)
+		return
+	}
 	pretty.Println("Decoded sdch header:", sdchHeader)
 
-	_, err = io.Copy(f, buffered)
+	if err := sdchHeader.CheckReferrer(referrer); err != nil {
+		log.Printf("Rejecting dict from %s: %s\n", referrer.Host, err)
+		return
+	}
+
+	// Without a Port, the dictionary is only good for the port it was
+	// announced on
+	ports := sdchHeader.Ports
+	if len(ports) == 0 {
+		ports = []int{sdch.URLPort(referrer)}
+	}
+
+	e, err := dicts.Put(header, content, store.Meta{
+		Domain:  sdchHeader.Domain,
+		Path:    sdchHeader.Path,
+		Ports:   ports,
+		Created: time.Now(),
+		MaxAge:  sdchHeader.Age(),
+	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	dictName = path.Base(url)
-	log.Println("Got dict", dictName)
+	if e.Name() != path.Base(dictUrl) {
+		log.Printf("Dict announced as %s is really %s, dropping it\n", path.Base(dictUrl), e.Name())
+		dicts.Delete(e.Hash)
+		return
+	}
+	log.Println("Got dict", e.Name())
+}
+
+// sdchEncoded is true for responses encoded with sdch, possibly
+// compressed on top.
+func sdchEncoded(r *http.Response, ctx *goproxy.ProxyCtx) bool {
+	codings := coding.Codings(r.Header)
+	return len(codings) > 0 && codings[0] == "sdch"
+}
+
+// retryWithoutSdch is used when an sdch response can't be decoded: it
+// sends the request again without sdch so that the user still gets the
+// page.
+func retryWithoutSdch(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	r.Body.Close()
+
+	req := r.Request
+	// The body of the request is gone, only retry those that had none
+	if req.Body != nil && req.ContentLength != 0 {
+		return goproxy.NewResponse(req, "text/plain", http.StatusBadGateway, "Could not decode sdch response\n")
+	}
+
+	withoutSdch(req.Header)
+	resp, err := ctx.RoundTrip(req)
+	if err != nil {
+		log.Println("Error retrying without sdch:", err)
+		return goproxy.NewResponse(req, "text/plain", http.StatusBadGateway, err.Error())
+	}
+	log.Println("Retried without sdch:", req.URL)
+	return resp
 }
 
 func main() {
+	configPath := flag.String("config", "", "configuration file")
+	listen := flag.String("listen", "", "address to listen on, overrides the configuration")
+	flag.Parse()
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *listen != "" {
+		conf.Client.Listen = *listen
+	}
+	if err := conf.ValidateClient(); err != nil {
+		log.Fatal(err)
+	}
+
 	proxy := goproxy.NewProxyHttpServer()
 
 	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if sdchDisabled(r.URL) {
+			return r, nil
+		}
 		r.Header.Add("Accept-Encoding", "sdch")
 
-		if len(dictName) > 0 {
-			rawId, err := hex.DecodeString(dictName)
-			if err != nil {
-				log.Println(err)
-				return r, nil
+		entries := scoped(r.URL)
+		if len(entries) > 0 {
+			ids := make([]string, 0, len(entries))
+			for _, e := range entries {
+				ids = append(ids, sdch.UserAgentId(e.Hash))
 			}
-			uaId := base64.URLEncoding.EncodeToString(rawId[:6])
-			r.Header.Set("Avail-Dictionary", uaId)
+			r.Header.Set("Avail-Dictionary", strings.Join(ids, ","))
 		}
 		return r, nil
 	})
@@ -79,97 +194,95 @@ func main() {
 			return r
 		}
 
-		dictName := path.Base(dictUrl)
-		_, err := os.Stat(path.Join("dicts", dictName))
+		hash, err := hex.DecodeString(path.Base(dictUrl))
 		if err != nil {
-			if os.IsNotExist(err) {
-				u, err := url.Parse(dictUrl)
-				if err != nil {
-					log.Println(err)
-					return r
-				}
-				if u.Scheme == "" {
-					dictUrl = "http://" + r.Request.Host + dictUrl
-				}
-				downloadDict(dictUrl)
-			}
+			log.Println(err)
+			return r
+		}
+		_, err = dicts.Entry(hash)
+		if err != store.ErrNotFound {
 			return r
 		}
 
+		u, err := url.Parse(dictUrl)
+		if err != nil {
+			log.Println(err)
+			return r
+		}
+		u = r.Request.URL.ResolveReference(u)
+		if u.Host != r.Request.URL.Host {
+			log.Printf("Ignoring dict from %s announced by %s\n", u.Host, r.Request.URL.Host)
+			return r
+		}
+		downloadDict(u.String(), r.Request.URL)
 		return r
 	})
 
-	proxy.OnResponse(goproxy.ContentTypeIs("sdch")).DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		var origBody bytes.Buffer
-		tr := bufio.NewReader(io.TeeReader(r.Body, &origBody))
+	proxy.OnResponse(goproxy.RespConditionFunc(sdchEncoded)).DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		// The server may have compressed on top of sdch
+		codings := coding.Codings(r.Header)
+		raw, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err == nil {
+			raw, err = coding.Decode(raw, codings[1:])
+		}
+		if err != nil {
+			log.Println("Error decoding sdch response:", err)
+			r.Body = ioutil.NopCloser(bytes.NewReader(nil))
+			reportProblem(r.Request.URL, problemDecodeError)
+			return retryWithoutSdch(r, ctx)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		tr := bufio.NewReader(r.Body)
 
 		serverId, err := tr.ReadString(byte(0))
 		if err != nil {
-			log.Println(err)
-			r.Body = ioutil.NopCloser(io.MultiReader(&origBody, r.Body))
-			return r
+			reportProblem(r.Request.URL, problemIdMalformed)
+			return retryWithoutSdch(r, ctx)
 		}
 		// Chop off the last 0x00
 		serverId = serverId[:len(serverId)-1]
-		rawServerId, err := base64.URLEncoding.DecodeString(serverId)
-		if err != nil {
-			log.Println(err)
-			r.Body = ioutil.NopCloser(io.MultiReader(&origBody, r.Body))
-			return r
-		}
-		ourDict, err := hex.DecodeString(dictName)
-		if err != nil {
-			log.Println(err)
-			r.Body = ioutil.NopCloser(io.MultiReader(&origBody, r.Body))
-			return r
+		// Only dictionaries in scope for this url may decode it
+		var ourDict []byte
+		for _, e := range scoped(r.Request.URL) {
+			if sdch.ServerId(e.Hash) == serverId {
+				ourDict = e.Hash
+				break
+			}
 		}
-		if bytes.Compare(rawServerId, ourDict[6:12]) != 0 {
-			r.Body = ioutil.NopCloser(io.MultiReader(&origBody, r.Body))
-			return r
+		if ourDict == nil {
+			reportProblem(r.Request.URL, problemDictionaryMissing)
+			return retryWithoutSdch(r, ctx)
 		}
 
-		cmd := exec.Command("vcdiff", "patch", "-dictionary", path.Join("dicts/", dictName), "-stats")
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stdin = tr
-
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
+		delta, _ := ioutil.ReadAll(tr)
+		decoded, err := vcdiff.Patch(dicts.ContentPath(ourDict), delta)
+		if err != nil {
 			log.Println(err)
+			if strings.Contains(err.Error(), "checksum") {
+				reportProblem(r.Request.URL, problemChecksum)
+			} else {
+				reportProblem(r.Request.URL, problemDecodeError)
+			}
+			return retryWithoutSdch(r, ctx)
 		}
-
-		log.Println("[VCDIFF]", stderr.String())
+		reportSuccess(r.Request.URL)
 
 		// TODO: send original content type in headers
 		r.Header.Set("Content-Type", "text/html")
-		r.Body = ioutil.NopCloser(&out)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.Body = ioutil.NopCloser(bytes.NewReader(decoded))
 		return r
 	})
 
 	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
 
-	os.Mkdir("dicts", 0755)
-	dir, err := os.Open("dicts")
-	if err != nil {
-		log.Fatal(err)
-	}
-	fis, err := dir.Readdir(-1)
+	dicts, err = store.Open(conf.Client.DictDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if len(fis) > 0 {
-		last := fis[0]
-		for _, fi := range fis[1:] {
-			if fi.ModTime().After(last.ModTime()) {
-				os.Remove(path.Join("dicts", last.Name()))
-				last = fi
-			}
-		}
-		dictName = last.Name()
-	}
-
 	log.Println("Let's go!")
-	log.Fatal(http.ListenAndServe(":8081", proxy))
+	log.Fatal(http.ListenAndServe(conf.Client.Listen, proxy))
 }
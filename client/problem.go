@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// problem classifies why an sdch response could not be decoded, after
+// Chromium's SDCH problem codes.
+type problem int
+
+const (
+	// The response doesn't start with a server id
+	problemIdMalformed problem = iota
+
+	// We hold no dictionary in scope with that server id
+	problemDictionaryMissing
+
+	// vcdiff could not decode the response
+	problemDecodeError
+
+	// vcdiff decoded the response but the checksum didn't match, usually
+	// because the wrong dictionary was used
+	problemChecksum
+)
+
+func (p problem) String() string {
+	switch p {
+	case problemIdMalformed:
+		return "DICTIONARY_HASH_MALFORMED"
+	case problemDictionaryMissing:
+		return "DICTIONARY_HASH_NOT_FOUND"
+	case problemDecodeError:
+		return "DECODE_BODY_ERROR"
+	case problemChecksum:
+		return "DECODE_CHECKSUM_ERROR"
+	}
+	return "UNKNOWN_PROBLEM"
+}
+
+const (
+	// After that many problems in a row, sdch is disabled for the origin
+	maxProblems = 3
+
+	// How long sdch stays disabled
+	disableDuration = 10 * time.Minute
+)
+
+type originState struct {
+	problems      int
+	disabledUntil time.Time
+}
+
+var (
+	originsMu sync.Mutex
+	origins   = make(map[string]*originState)
+)
+
+func origin(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// sdchDisabled is true when too many problems happened recently with
+// the origin of u.
+func sdchDisabled(u *url.URL) bool {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+
+	st, ok := origins[origin(u)]
+	if !ok {
+		return false
+	}
+	return time.Now().Before(st.disabledUntil)
+}
+
+// reportProblem records a problem with the origin of u, and disables sdch
+// for it once there were too many of them in a row.
+func reportProblem(u *url.URL, p problem) {
+	o := origin(u)
+	log.Printf("[SDCH] %s for %s\n", p, u)
+
+	originsMu.Lock()
+	defer originsMu.Unlock()
+
+	st, ok := origins[o]
+	if !ok {
+		st = &originState{}
+		origins[o] = st
+	}
+	st.problems++
+	if st.problems >= maxProblems {
+		log.Printf("[SDCH] Disabling sdch for %s for %s\n", o, disableDuration)
+		st.disabledUntil = time.Now().Add(disableDuration)
+		st.problems = 0
+	}
+}
+
+// reportSuccess forgets the past problems with the origin of u.
+func reportSuccess(u *url.URL) {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	delete(origins, origin(u))
+}
+
+// withoutSdch removes sdch from the encodings accepted by a request.
+func withoutSdch(h http.Header) {
+	h.Del("Avail-Dictionary")
+
+	aes := h["Accept-Encoding"]
+	h.Del("Accept-Encoding")
+	for _, ae := range aes {
+		kept := make([]string, 0)
+		for _, each := range strings.Split(ae, ",") {
+			each = strings.TrimSpace(each)
+			name := strings.TrimSpace(strings.Split(each, ";")[0])
+			if each == "" || name == "sdch" {
+				continue
+			}
+			kept = append(kept, each)
+		}
+		if len(kept) > 0 {
+			h.Add("Accept-Encoding", strings.Join(kept, ", "))
+		}
+	}
+}
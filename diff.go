@@ -2,23 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/hex"
 	"log"
-	"os/exec"
-	"path"
 	"time"
+
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/vcdiff"
 )
 
-func (bh *bodyHandler) makeDiff(body []byte) (newBody []byte, err error) {
+func (bh *bodyHandler) makeDiff(body []byte, dv *dictVersion) (newBody []byte, err error) {
 	startDelta := time.Now()
 
-	fullDictHash := path.Base(bh.DictName())
-	rawServerId, err := hex.DecodeString(fullDictHash)
-	serverId := base64.URLEncoding.EncodeToString(rawServerId[6:12])
-	if err != nil {
-		return body, err
-	}
+	serverId := sdch.ServerId(dv.Hash)
 
 	var out bytes.Buffer
 	if _, err = out.WriteString(serverId); err != nil {
@@ -28,19 +22,11 @@ func (bh *bodyHandler) makeDiff(body []byte) (newBody []byte, err error) {
 		return body, err
 	}
 
-	cmd := exec.Command("vcdiff", "delta", "-dictionary", bh.DictName(), "-interleaved", "-checksum", "-stats")
-	cmd.Stdin = bytes.NewReader(body)
-
-	cmd.Stdout = &out
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
+	delta, err := vcdiff.Delta(bh.store.ContentPath(dv.Hash), body)
+	if err != nil {
 		return body, err
 	}
-
-	log.Printf("[VCDIFF-DELTA] %s\n", stderr.String())
+	out.Write(delta)
 
 	log.Printf("Generated delta in %f msecs\n", time.Since(startDelta).Seconds()*1000)
 	return out.Bytes(), nil
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+const (
+	// How often the collector looks for expired dictionaries
+	gcInterval = 1 * time.Minute
+)
+
+// dictVersion is a dictionary published by the proxy. Once superseded it
+// is not advertised anymore, but it is still used for encoding until its
+// Max-Age runs out, because clients may have fetched it right before it
+// was retired.
+type dictVersion struct {
+	store.Entry
+
+	// Zero as long as this is the advertised dictionary
+	retired time.Time
+}
+
+func (dv *dictVersion) expired(now time.Time) bool {
+	if dv.retired.IsZero() {
+		return false
+	}
+	return now.After(dv.retired.Add(dv.MaxAge))
+}
+
+// publish makes dv the advertised dictionary and retires the previous one.
+// Retirements are recorded, so that grace periods survive restarts.
+func (bh *bodyHandler) publish(dv *dictVersion) error {
+	now := time.Now()
+	prev := bh.Current()
+	if prev != nil && !bytes.Equal(prev, dv.Hash) {
+		if err := bh.saveRetired(prev, now); err != nil {
+			return err
+		}
+	}
+	if _, err := bh.db.Exec(`DELETE FROM retired WHERE hash = ?`, dv.Hash); err != nil {
+		return err
+	}
+
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	if bh.current != nil && !bytes.Equal(bh.current.Hash, dv.Hash) {
+		bh.current.retired = now
+		bh.retired = append(bh.retired, bh.current)
+	}
+
+	// dv may be a retired dictionary being promoted again
+	kept := bh.retired[:0]
+	for _, old := range bh.retired {
+		if !bytes.Equal(old.Hash, dv.Hash) {
+			kept = append(kept, old)
+		}
+	}
+	bh.retired = kept
+	bh.current = dv
+	return nil
+}
+
+func (bh *bodyHandler) saveRetired(hash []byte, at time.Time) error {
+	_, err := bh.db.Exec(`INSERT OR REPLACE INTO retired (hash, retired) VALUES (?, ?)`, hash, at.Unix())
+	return err
+}
+
+// version returns the dictionary with the given name, if it is either
+// the current one or a retired one still in its grace period.
+func (bh *bodyHandler) version(name string) *dictVersion {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	if bh.current != nil && bh.current.Name() == name {
+		return bh.current
+	}
+	now := time.Now()
+	for _, dv := range bh.retired {
+		if dv.Name() == name && !dv.expired(now) {
+			return dv
+		}
+	}
+	return nil
+}
+
+// chooseVersion returns the best dictionary among the ones the client
+// holds, given by their user agent ids: the advertised one if possible,
+// or else the most recently retired one still in its grace period.
+func (bh *bodyHandler) chooseVersion(uaIds []string) *dictVersion {
+	held := make(map[string]bool, len(uaIds))
+	for _, id := range uaIds {
+		held[id] = true
+	}
+
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	if bh.current != nil && held[sdch.UserAgentId(bh.current.Hash)] {
+		return bh.current
+	}
+
+	var best *dictVersion
+	now := time.Now()
+	for _, dv := range bh.retired {
+		if !held[sdch.UserAgentId(dv.Hash)] || dv.expired(now) {
+			continue
+		}
+		if best == nil || dv.retired.After(best.retired) {
+			best = dv
+		}
+	}
+	return best
+}
+
+// manifest describes the advertised dictionary and the retired ones still
+// in their grace period.
+func (bh *bodyHandler) manifest() []store.ManifestEntry {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	manifest := make([]store.ManifestEntry, 0, len(bh.retired)+1)
+	if bh.current != nil {
+		manifest = append(manifest, store.NewManifestEntry(bh.current.Entry, nil))
+	}
+	now := time.Now()
+	for i := len(bh.retired) - 1; i >= 0; i-- {
+		dv := bh.retired[i]
+		if dv.expired(now) {
+			continue
+		}
+		expires := dv.retired.Add(dv.MaxAge)
+		manifest = append(manifest, store.NewManifestEntry(dv.Entry, &expires))
+	}
+	return manifest
+}
+
+// collect periodically deletes the dictionaries whose grace period is over.
+func (bh *bodyHandler) collect() {
+	for now := range time.Tick(gcInterval) {
+		bh.gc(now)
+	}
+}
+
+func (bh *bodyHandler) gc(now time.Time) {
+	bh.mu.Lock()
+	var expired []*dictVersion
+	kept := bh.retired[:0]
+	for _, dv := range bh.retired {
+		if dv.expired(now) {
+			expired = append(expired, dv)
+		} else {
+			kept = append(kept, dv)
+		}
+	}
+	bh.retired = kept
+	bh.mu.Unlock()
+
+	for _, dv := range expired {
+		log.Println("Collecting dict", dv.Name())
+		if err := bh.store.Delete(dv.Hash); err != nil {
+			log.Println("Error removing dict:", err)
+			continue
+		}
+		if _, err := bh.db.Exec(`DELETE FROM retired WHERE hash = ?`, dv.Hash); err != nil {
+			log.Println("Error removing dict:", err)
+		}
+	}
+}
+
+// loadDicts rebuilds the list of published dictionaries from the store.
+// The pinned one, or else the most recent one, is advertised. The others
+// are retired since the time recorded by publish; without one, as left by
+// previous versions, from the moment their successor was published.
+func (bh *bodyHandler) loadDicts() error {
+	entries, err := bh.store.List()
+	if err != nil {
+		return err
+	}
+	pinned, err := bh.loadPinned()
+	if err != nil {
+		return err
+	}
+	retirements, err := bh.loadRetired()
+	if err != nil {
+		return err
+	}
+
+	var successor *dictVersion
+	for _, e := range entries {
+		dv := &dictVersion{Entry: e}
+		if successor != nil {
+			dv.retired = successor.Created
+		}
+		successor = dv
+
+		if bh.current == nil && (pinned == nil || bytes.Equal(e.Hash, pinned)) {
+			dv.retired = time.Time{}
+			bh.current = dv
+			continue
+		}
+		if at, ok := retirements[e.Name()]; ok {
+			dv.retired = at
+		} else {
+			if dv.retired.IsZero() {
+				// Newer than the pinned one
+				dv.retired = time.Now()
+			}
+			if err := bh.saveRetired(e.Hash, dv.retired); err != nil {
+				return err
+			}
+		}
+		bh.retired = append(bh.retired, dv)
+	}
+	bh.pinned = pinned != nil && bh.current != nil
+
+	bh.gc(time.Now())
+	return nil
+}
+
+// loadRetired returns the recorded retirement times, by dictionary name.
+func (bh *bodyHandler) loadRetired() (map[string]time.Time, error) {
+	rows, err := bh.db.Query(`SELECT hash, retired FROM retired`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retirements := make(map[string]time.Time)
+	for rows.Next() {
+		var hash []byte
+		var at int64
+		if err := rows.Scan(&hash, &at); err != nil {
+			return nil, err
+		}
+		retirements[hex.EncodeToString(hash)] = time.Unix(at, 0)
+	}
+	return retirements, rows.Err()
+}
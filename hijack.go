@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// hijacks tracks the connections hijacked for CONNECT, MITM'd or
+// tunneled: the http.Server forgets them, so Shutdown doesn't wait for
+// the responses they carry.
+type hijacks struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[*hijackedConn]bool
+}
+
+func newHijacks() *hijacks {
+	return &hijacks{conns: make(map[*hijackedConn]bool)}
+}
+
+// handler tracks the connections next hijacks.
+func (h *hijacks) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hj, ok := w.(http.Hijacker); ok {
+			w = hijackWriter{ResponseWriter: w, hj: hj, h: h}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait waits for the hijacked connections to be closed, which for MITM
+// means that their response was sent. When ctx is done first, the
+// remaining ones are closed.
+func (h *hijacks) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	h.mu.Lock()
+	for c := range h.conns {
+		c.Conn.Close()
+	}
+	h.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+type hijackWriter struct {
+	http.ResponseWriter
+	hj http.Hijacker
+	h  *hijacks
+}
+
+// Hijack counts the connection before it is taken from the http.Server,
+// so that it is counted before Shutdown returns.
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.h.wg.Add(1)
+	conn, rw, err := w.hj.Hijack()
+	if err != nil {
+		w.h.wg.Done()
+		return nil, nil, err
+	}
+
+	c := &hijackedConn{Conn: conn, h: w.h}
+	w.h.mu.Lock()
+	w.h.conns[c] = true
+	w.h.mu.Unlock()
+	return c, rw, nil
+}
+
+func (w hijackWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type hijackedConn struct {
+	net.Conn
+	h    *hijacks
+	once sync.Once
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.h.mu.Lock()
+		delete(c.h.conns, c)
+		c.h.mu.Unlock()
+		c.h.wg.Done()
+	})
+	return err
+}
@@ -2,32 +2,53 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"database/sql"
-	"encoding/base64"
-	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
-	"path"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/elazarl/goproxy"
+	"github.com/rakoo/mmas/pkg/admin"
+	"github.com/rakoo/mmas/pkg/clients"
+	"github.com/rakoo/mmas/pkg/coding"
+	"github.com/rakoo/mmas/pkg/config"
+	"github.com/rakoo/mmas/pkg/sample"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
-	DICT_PATH     = "/var/tmp/mmas-dict/"
-	DICT_HDR_PATH = "/var/tmp/mmas-dict-hdr/"
-	CHUNKS_PATH   = "/var/tmp/mmas-chunks"
+	CHUNKS_PATH = "/var/tmp/mmas-chunks"
+
+	schema = `CREATE TABLE IF NOT EXISTS chunks (
+		content BLOB,
+		hash BLOB UNIQUE ON CONFLICT REPLACE,
+		count INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS pinned (
+		id INTEGER PRIMARY KEY CHECK (id = 0),
+		hash BLOB
+	);
+	CREATE TABLE IF NOT EXISTS retired (
+		hash BLOB PRIMARY KEY,
+		retired INTEGER
+	);` + clients.Schema
 )
 
 var (
@@ -36,91 +57,138 @@ var (
 )
 
 type bodyHandler struct {
+	confMu  sync.RWMutex
+	conf    *config.Config
+	hosts   *regexp.Regexp
+	sampler *sample.Sampler
+
+	// Background learning, waited for on shutdown
+	workMu  sync.Mutex
+	work    sync.WaitGroup
+	closing bool
+
 	db       *sql.DB
+	store    *store.Store
 	topChunk []byte
 
-	mu              sync.Mutex
-	dictFileName    string
-	dictHdrFileName string
-}
+	// Hashes client addresses
+	salt []byte
 
-func (bh *bodyHandler) DictName() string {
-	var ret string
-	bh.mu.Lock()
-	ret = bh.dictFileName
-	bh.mu.Unlock()
-	return ret
+	mu      sync.Mutex
+	current *dictVersion
+	retired []*dictVersion
+
+	// When pinned, the dictionary is not rotated anymore
+	pinned bool
 }
 
-func (bh *bodyHandler) DictHdrName() string {
+func (bh *bodyHandler) DictName() string {
 	var ret string
 	bh.mu.Lock()
-	ret = bh.dictHdrFileName
+	if bh.current != nil {
+		ret = bh.current.Name()
+	}
 	bh.mu.Unlock()
 	return ret
 }
 
-func (bh *bodyHandler) SetDictName(name string) {
-	bh.mu.Lock()
-	bh.dictFileName = name
-	bh.mu.Unlock()
-}
-
-func (bh *bodyHandler) SetDictHdrName(name string) {
-	bh.mu.Lock()
-	bh.dictHdrFileName = name
-	bh.mu.Unlock()
+// keepAcceptEncoding saves the Accept-Encoding of the request for handle:
+// goproxy removes it before forwarding the request.
+func keepAcceptEncoding(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	ctx.UserData = r.Header["Accept-Encoding"]
+	return r, nil
 }
 
 func (bh *bodyHandler) handle(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if ae, ok := ctx.UserData.([]string); ok {
+		r.Request.Header["Accept-Encoding"] = ae
+	}
+
 	// Set it to not-sdch-encoded by default
 	r.Header.Set("X-Sdch-Encode", "0")
 
-	var content []byte
-	var err error
-
-	// Un-gzip on the fly
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		gzr, err := gzip.NewReader(r.Body)
-		if err != nil {
-			return r
-		}
+	if !sdch.Encodable(r.Request, r.StatusCode) {
+		return r
+	}
+	if r.Request.Method == "HEAD" {
+		return bh.head(r, ctx)
+	}
+	learn := sdch.Learnable(r.Request, r.StatusCode) &&
+		!bh.config().Privacy.Rules().Personal(r.Request, r.Header)
+	return bh.encode(r, learn)
+}
 
-		content, err = ioutil.ReadAll(gzr)
-		if err != nil {
-			return r
-		}
-		gzr.Close()
+// head answers HEAD with the headers the GET would get: it does the GET,
+// encodes it without learning from it, and drops the body.
+func (bh *bodyHandler) head(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	get := new(http.Request)
+	*get = *r.Request
+	get.Method = "GET"
+	resp, err := ctx.RoundTrip(get)
+	if err != nil {
+		log.Println("Error getting for HEAD:", err)
+		return r
+	}
+	if !sdch.Encodable(get, resp.StatusCode) {
+		resp.Body.Close()
+		return r
+	}
+	r.Body.Close()
 
-		var buf bytes.Buffer
-		gzw := gzip.NewWriter(&buf)
-		gzw.Write(content)
-		gzw.Close()
-		r.Body = ioutil.NopCloser(&buf)
+	resp.Header.Set("X-Sdch-Encode", "0")
+	resp = bh.encode(resp, false)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Println("Error getting for HEAD:", err)
+		return goproxy.NewResponse(r.Request, "text/plain", http.StatusBadGateway, "")
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	resp.Request = r.Request
+	return resp
+}
 
-	} else {
-		content, err = ioutil.ReadAll(r.Body)
-		if err != nil {
-			return r
-		}
-		r.Body = ioutil.NopCloser(bytes.NewReader(content))
+// encode learns from the response if asked to, and sdch-encodes it if the
+// client can decode it.
+func (bh *bodyHandler) encode(r *http.Response, learn bool) *http.Response {
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return r
 	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(raw))
 
-	go func() {
-		_, err := bh.parseResponse(content)
-		if err != nil {
-			log.Println("Error parsing content:", err)
-			return
-		}
+	// Learn from the actual content, whatever the upstream encoding, but
+	// pass the original bytes along
+	codings := coding.Codings(r.Header)
+	content, err := coding.Decode(raw, codings)
+	if err != nil {
+		log.Printf("Not learning from %s (%s): %s\n", r.Request.URL, strings.Join(codings, ", "), err)
+		return r
+	}
 
-		if len(bh.DictName()) == 0 {
-			err = bh.makeDict(r.Request.Host)
+	sampler := bh.getSampler()
+	if learn && sampler.Sample(r.Request.Host+r.Request.URL.RequestURI()) {
+		client := clients.Id(bh.salt, r.Request.RemoteAddr)
+		bh.learn(func() {
+			start := time.Now()
+			_, err := bh.parseResponse(content, client)
+			sampler.Spent(time.Since(start))
 			if err != nil {
-				log.Println("Error making dict:", err)
+				log.Println("Error parsing content:", err)
 				return
 			}
-		}
-	}()
+
+			if len(bh.DictName()) == 0 {
+				err = bh.makeDict(r.Request.URL)
+				if err != nil {
+					log.Println("Error making dict:", err)
+					return
+				}
+			}
+		})
+	}
 
 	if len(bh.DictName()) > 0 {
 
@@ -131,10 +199,15 @@ func (bh *bodyHandler) handle(r *http.Response, ctx *goproxy.ProxyCtx) *http.Res
 		if !strings.Contains(r.Request.Host, ":") {
 			hostport = hostport + ":80"
 		}
-		dictName := path.Base(bh.DictName())
-		dictUrl := fmt.Sprintf("/_dictionary/%s/%s", hostport, dictName)
+		dictUrl := fmt.Sprintf("/_dictionary/%s/%s", hostport, bh.DictName())
 		r.Header.Set("Get-Dictionary", dictUrl)
 
+		if sdch.NoTransform(r.Header) || sdch.NoTransform(r.Request.Header) {
+			return r
+		}
+		// From now on the response depends on what the client holds
+		sdch.AddVary(r.Header)
+
 		// Check if client can SDCH
 		acceptedEncodings := r.Request.Header["Accept-Encoding"]
 		canSdch := false
@@ -150,61 +223,48 @@ func (bh *bodyHandler) handle(r *http.Response, ctx *goproxy.ProxyCtx) *http.Res
 			return r
 		}
 
-		// Like Chromium, we only take the first one
-		availDicts := r.Request.Header.Get("Avail-Dictionary")
-		split := strings.Split(availDicts, ",")
-		if split[0] == "" {
-			return r
-		}
-
-		uaId, err := base64.URLEncoding.DecodeString(strings.TrimSpace(split[0]))
-		if err != nil {
-			log.Println(err)
-			return r
-		}
-
-		rawDict, err := hex.DecodeString(dictName)
-		if err != nil {
-			log.Println(err)
-			return r
-		}
-		if bytes.Compare(rawDict[:6], uaId) != 0 {
+		// The client may hold several dictionaries, some of them retired
+		dv := bh.chooseVersion(sdch.AvailDictionaries(r.Request.Header))
+		if dv == nil {
 			return r
 		}
 
 		var newBody io.ReadCloser
-		compressedBodyContent, err := bh.makeDiff(content)
+		compressedBodyContent, err := bh.makeDiff(content, dv)
 		if err != nil {
 			log.Println("[MAKEDIFF]", err)
 			return r
 		}
 		if len(compressedBodyContent) < len(content) {
-			r.Header.Del("X-Sdch-Encode")
-
-			if r.Header.Get("Content-Encoding") == "gzip" {
-				var buf bytes.Buffer
-				gzw := gzip.NewWriter(&buf)
-				gzw.Write(compressedBodyContent)
-				gzw.Close()
-				newBody = ioutil.NopCloser(&buf)
-				r.Header.Set("Content-Encoding", "sdch, gzip")
-
-				statsBytesSent += uint64(buf.Len())
+			// Whatever the upstream did, compress on top of the sdch
+			// encoding as the client prefers
+			outer := coding.Negotiate(r.Request.Header, coding.Preferred...)
+			if outer != "" {
+				encoded, err := coding.Encode(compressedBodyContent, []string{outer})
+				if err != nil {
+					log.Println("Error encoding:", err)
+					return r
+				}
+				newBody = ioutil.NopCloser(bytes.NewReader(encoded))
+				r.Header.Set("Content-Encoding", "sdch, "+outer)
 
-				var origBuf bytes.Buffer
-				origGzw := gzip.NewWriter(&origBuf)
-				origGzw.Write(content)
-				origGzw.Close()
-				statsBytesOriginal += uint64(origBuf.Len())
+				statsBytesSent += uint64(len(encoded))
+				statsBytesOriginal += uint64(len(raw))
 
-				ratio := 100 * float64(buf.Len()) / float64(origBuf.Len())
-				log.Printf("After gzip: %d -> %d (%f %%)\n", origBuf.Len(), buf.Len(), ratio)
+				ratio := 100 * float64(len(encoded)) / float64(len(raw))
+				log.Printf("After %s: %d -> %d (%f %%)\n", outer, len(raw), len(encoded), ratio)
 
 			} else {
 				newBody = ioutil.NopCloser(bytes.NewBuffer(compressedBodyContent))
+				r.Header.Set("Content-Encoding", "sdch")
 				statsBytesSent += uint64(len(compressedBodyContent))
-				statsBytesOriginal += uint64(len(content))
+				statsBytesOriginal += uint64(len(raw))
 			}
+			r.Header.Del("X-Sdch-Encode")
+			r.Header.Set(sdch.DebugHeader, dv.Name())
+			sdch.SetEncodedETag(r.Header, sdch.ServerId(dv.Hash), outer)
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
 			r.Body = newBody
 
 			saved := 100 * (1 - float64(statsBytesSent)/float64(statsBytesOriginal))
@@ -217,10 +277,34 @@ func (bh *bodyHandler) handle(r *http.Response, ctx *goproxy.ProxyCtx) *http.Res
 
 var last = time.Now()
 
+// How long in-flight requests have to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
 func main() {
+	configPath := flag.String("config", "", "configuration file")
+	listen := flag.String("listen", "", "address to listen on, overrides the configuration")
+	flag.Parse()
+
+	// Also used on SIGHUP, so that overrides stay in effect
+	loadConfig := func() (*config.Config, error) {
+		conf, err := config.Load(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if *listen != "" {
+			conf.Proxy.Listen = *listen
+		}
+		return conf, conf.ValidateProxy()
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	proxy := goproxy.NewProxyHttpServer()
 
-	db, err := sql.Open("sqlite3", "memory")
+	db, err := sql.Open("sqlite3", conf.Proxy.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -229,69 +313,66 @@ func main() {
 		log.Fatal(err)
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS chunks (
-		content BLOB,
-		hash BLOB UNIQUE ON CONFLICT REPLACE,
-		count INTEGER
-	);`)
+	_, err = db.Exec(schema)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bh := &bodyHandler{
-		db: db,
+	salt, err := clients.LoadSalt(db)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	matchPath := regexp.MustCompile("reddit.com")
-	proxy.OnResponse(
-		goproxy.ContentTypeIs("text/html"),
-		goproxy.ReqHostMatches(matchPath),
-	).DoFunc(bh.handle)
-	proxy.OnResponse(
-		goproxy.ReqHostMatches(matchPath),
-	).DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		r.Header.Set("X-Sdch-Encoding", "0")
-		return r
-	})
-	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
-
-	err = os.Mkdir(DICT_PATH, 0755)
-	if err != nil && !os.IsExist(err) {
+	st, err := store.Open(conf.Proxy.DictDir)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = os.Mkdir(DICT_HDR_PATH, 0755)
-	if err != nil && !os.IsExist(err) {
-		log.Fatal(err)
+	bh := &bodyHandler{
+		db:    db,
+		store: st,
+		salt:  salt,
 	}
+	bh.setConfig(conf)
 
-	dir, err := os.Open(DICT_PATH)
-	if err != nil {
-		log.Fatal(err)
+	if flag.NArg() > 0 {
+		if err := bh.runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	fis, err := dir.Readdir(-1)
+
+	proxy.OnRequest().DoFunc(keepAcceptEncoding)
+	// Hosts and content types are looked up on each response, as they
+	// change on reload
+	proxy.OnResponse(goproxy.RespConditionFunc(bh.encodable)).DoFunc(bh.handle)
+	proxy.OnResponse(goproxy.RespConditionFunc(bh.forHost)).DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		r.Header.Set("X-Sdch-Encoding", "0")
+		return r
+	})
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	err = bh.loadDicts()
 	if err != nil {
 		log.Fatal(err)
 	}
+	go bh.collect()
 
-	if len(fis) > 0 {
-		current := fis[0]
-		for _, fi := range fis[1:] {
-			if fi.ModTime().After(current.ModTime()) {
-				err := os.Remove(path.Join(DICT_PATH, fi.Name()))
-				if err != nil {
-					log.Fatal(err)
-				}
-				err = os.Remove(path.Join(DICT_HDR_PATH, fi.Name()))
-				if err != nil {
-					log.Fatal(err)
-				}
-				current = fi
-			}
-		}
-		bh.SetDictName(path.Join(DICT_PATH, current.Name()))
-		bh.SetDictHdrName(path.Join(DICT_HDR_PATH, current.Name()))
+	token := os.Getenv("MMAS_ADMIN_TOKEN")
+	if token == "" {
+		log.Println("MMAS_ADMIN_TOKEN is not set, admin API is disabled")
 	}
+	// The admin API is for requests to the proxy itself: proxied hosts
+	// keep their own /_admin/
+	adminHandler := admin.Handler("/_admin/", bh, token)
+	nonProxy := proxy.NonproxyHandler
+	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_admin/") {
+			adminHandler.ServeHTTP(w, r)
+			return
+		}
+		nonProxy.ServeHTTP(w, r)
+	})
 
 	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		if !strings.HasPrefix(r.URL.Path, "/_dictionary") {
@@ -299,6 +380,19 @@ func main() {
 		}
 
 		dictQuery := strings.Replace(r.URL.Path, "/_dictionary/", "", 1)
+		if dictQuery == "manifest.json" {
+			body, err := json.Marshal(bh.manifest())
+			if err != nil {
+				log.Println(err)
+				resp := goproxy.NewResponse(r, "text/plain", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return nil, resp
+			}
+			resp := goproxy.NewResponse(r, "application/json", http.StatusOK, string(body))
+			resp.Header.Set("Cache-Control", "no-cache")
+			resp.Header.Set("X-Sdch-Encode", "0")
+			return nil, resp
+		}
+
 		parts := strings.Split(dictQuery, "/")
 		if len(parts) != 2 {
 			log.Println("Wrong query:", dictQuery)
@@ -306,50 +400,72 @@ func main() {
 			return nil, resp
 		}
 
-		dictName := parts[1]
-
-		if dictName != path.Base(bh.DictName()) {
-			log.Println(err)
+		dv := bh.version(parts[1])
+		if dv == nil {
+			log.Println("Unknown dict:", parts[1])
 			resp := goproxy.NewResponse(r, "text/plain", http.StatusNotFound, http.StatusText(http.StatusNotFound))
 			return nil, resp
 		}
 
-		dict, modTime, err := bh.makeSdchDict()
+		d, err := bh.store.Get(dv.Hash)
 		if err != nil {
 			log.Println(err)
 			resp := goproxy.NewResponse(r, "text/plain", http.StatusNotFound, http.StatusText(http.StatusNotFound))
 			return nil, resp
 		}
 
-		size, err1 := dict.Seek(0, os.SEEK_END)
-		_, err2 := dict.Seek(0, os.SEEK_SET)
-		if err1 != nil || err2 != nil {
-			log.Println(err, err2)
-			resp := goproxy.NewResponse(r, "text/plain", http.StatusNotFound, http.StatusText(http.StatusNotFound))
-			return nil, resp
-		}
-
-		resp := &http.Response{}
+		rr := httptest.NewRecorder()
+		bh.store.ServeDictionary(rr, r, d)
+		resp := rr.Result()
 		resp.Request = r
-		resp.TransferEncoding = r.TransferEncoding
-		resp.Header = make(http.Header)
-		resp.Header.Add("Content-Type", "application/x-sdch-dictionary")
-		resp.Header.Add("Content-Length", strconv.Itoa(int(size)))
-		resp.Header.Add("X-Sdch-Encode", "0")
-		resp.Header.Add("Date", time.Now().Format(time.RFC1123))
-		resp.Header.Add("Expires", time.Now().Add(1*time.Hour).Format(time.RFC1123))
-		resp.Header.Add("Last-Modified", modTime.Format(time.RFC1123))
-
-		resp.StatusCode = 200
-		resp.ContentLength = size
-		resp.Body = ioutil.NopCloser(dict)
+		resp.Header.Set("X-Sdch-Encode", "0")
 
 		log.Println("Sending back dict")
 		return nil, resp
 	})
 
+	hj := newHijacks()
+	srv := &http.Server{Addr: conf.Proxy.Listen, Handler: hj.handler(proxy)}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 	log.Println("Let's go !")
-	log.Fatal(http.ListenAndServe(":8080", proxy))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Println("Reloading configuration")
+		newConf, err := loadConfig()
+		if err != nil {
+			log.Println("Not reloading:", err)
+			continue
+		}
+		if newConf.Proxy.Listen != conf.Proxy.Listen || newConf.Proxy.Database != conf.Proxy.Database || newConf.Proxy.DictDir != conf.Proxy.DictDir {
+			log.Println("Listen address, database and dict_dir only change on restart")
+		}
+		bh.setConfig(newConf)
+	}
+
+	// Hijacked connections, used for MITM, are waited for with the same
+	// timeout
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down:", err)
+	}
+	if err := hj.wait(ctx); err != nil {
+		log.Println("Error waiting for hijacked connections:", err)
+	}
+	if err := bh.close(); err != nil {
+		log.Println("Error closing database:", err)
+	}
+	log.Println("Bye")
 }
 
 type byDateInv []os.FileInfo
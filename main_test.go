@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/rakoo/mmas/pkg/clients"
+	"github.com/rakoo/mmas/pkg/config"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+const testPage = "<html><body>Hello, this is a page</body></html>"
+
+// fakeVcdiff puts first on the PATH a vcdiff that answers any delta with
+// a few bytes, so that responses get encoded without the real one.
+func fakeVcdiff(t *testing.T, dir string) (restore func()) {
+	script := "#!/bin/sh\ncat >/dev/null\nprintf delta\n"
+	if err := ioutil.WriteFile(path.Join(dir, "vcdiff"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return func() { os.Setenv("PATH", oldPath) }
+}
+
+// newTestHandler makes a bodyHandler learning from all the responses, with
+// an advertised dictionary whose user agent id is uaId.
+func newTestHandler(t *testing.T) (bh *bodyHandler, uaId string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mmas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := fakeVcdiff(t, dir)
+	fail := func(err error) {
+		restore()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path.Join(dir, "chunks"))
+	if err != nil {
+		fail(err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		fail(err)
+	}
+	salt, err := clients.LoadSalt(db)
+	if err != nil {
+		fail(err)
+	}
+	st, err := store.Open(path.Join(dir, "dicts"))
+	if err != nil {
+		fail(err)
+	}
+
+	conf := config.Default()
+	conf.Proxy.Hosts = "."
+	conf.Proxy.ContentTypes = []string{"text/html"}
+	bh = &bodyHandler{db: db, store: st, salt: salt}
+	bh.setConfig(conf)
+
+	e, err := st.Put([]byte("Domain: 127.0.0.1\nPath: /\n\n"), []byte(testPage), store.Meta{
+		Domain:  "127.0.0.1",
+		Path:    "/",
+		Created: time.Now(),
+		MaxAge:  time.Hour,
+	})
+	if err != nil {
+		fail(err)
+	}
+	if err := bh.publish(&dictVersion{Entry: e}); err != nil {
+		fail(err)
+	}
+
+	cleanup = func() {
+		bh.close()
+		restore()
+		os.RemoveAll(dir)
+	}
+	return bh, sdch.UserAgentId(e.Hash), cleanup
+}
+
+// newTestClient sends its requests through a proxy using bh, as main
+// sets it up.
+func newTestClient(t *testing.T, bh *bodyHandler) (client *http.Client, cleanup func()) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(keepAcceptEncoding)
+	proxy.OnResponse(goproxy.RespConditionFunc(bh.encodable)).DoFunc(bh.handle)
+	front := httptest.NewServer(proxy)
+
+	proxyURL, err := url.Parse(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(proxyURL),
+		DisableCompression: true,
+	}}
+	return client, front.Close
+}
+
+// sampled is the number of responses the proxy learned from so far.
+func sampled() int64 {
+	vars := expvar.Get("sampling").(*expvar.Map).Get("proxy").(*expvar.Map)
+	return vars.Get("sampled").(*expvar.Int).Value()
+}
+
+// encoded is true when the response is sdch-encoded.
+func encoded(h http.Header) bool {
+	return strings.Contains(h.Get("Content-Encoding"), "sdch")
+}
+
+func TestHeadLikeGet(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testPage))
+	}))
+	defer upstream.Close()
+
+	bh, uaId, cleanup := newTestHandler(t)
+	defer cleanup()
+	client, stop := newTestClient(t, bh)
+	defer stop()
+
+	do := func(method string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, upstream.URL+"/page", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "sdch")
+		req.Header.Set("Avail-Dictionary", uaId)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Header.Del("Date")
+		return resp, body
+	}
+
+	before := sampled()
+	head, body := do("HEAD")
+	if len(body) != 0 {
+		t.Errorf("HEAD has a body: %q", body)
+	}
+	if n := sampled() - before; n != 0 {
+		t.Errorf("Learned from %d HEAD responses", n)
+	}
+
+	get, body := do("GET")
+	if !encoded(get.Header) {
+		t.Errorf("GET is not encoded: %v", get.Header)
+	}
+	if len(body) == 0 || string(body) == testPage {
+		t.Errorf("GET body is %q", body)
+	}
+	if n := sampled() - before; n != 1 {
+		t.Errorf("Learned from %d GET responses, want 1", n)
+	}
+
+	if head.StatusCode != get.StatusCode {
+		t.Errorf("HEAD status is %d, GET is %d", head.StatusCode, get.StatusCode)
+	}
+	// goproxy drops the Content-Length of the bodies handle changed, and
+	// net/http only puts it back on short GET responses
+	head.Header.Del("Content-Length")
+	get.Header.Del("Content-Length")
+	if !reflect.DeepEqual(head.Header, get.Header) {
+		t.Errorf("HEAD headers differ from GET:\n%v\n%v", head.Header, get.Header)
+	}
+}
+
+func TestNotEncodedPassedThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch {
+		case r.Header.Get("Range") != "":
+			w.Header().Set("Content-Range", "bytes 0-19/48")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(testPage[:20]))
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(testPage))
+		default:
+			w.Write([]byte(testPage))
+		}
+	}))
+	defer upstream.Close()
+
+	bh, uaId, cleanup := newTestHandler(t)
+	defer cleanup()
+	client, stop := newTestClient(t, bh)
+	defer stop()
+
+	get := func(path, rangeHdr string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", upstream.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "sdch")
+		req.Header.Set("Avail-Dictionary", uaId)
+		if rangeHdr != "" {
+			req.Header.Set("Range", rangeHdr)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	before := sampled()
+	for _, c := range []struct {
+		path, rangeHdr string
+		status         int
+		body           string
+	}{
+		{"/missing", "", http.StatusNotFound, testPage},
+		{"/page", "bytes=0-19", http.StatusPartialContent, testPage[:20]},
+	} {
+		resp, body := get(c.path, c.rangeHdr)
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %q: status %d, want %d", c.path, c.rangeHdr, resp.StatusCode, c.status)
+		}
+		if encoded(resp.Header) {
+			t.Errorf("%s %q: encoded as %q", c.path, c.rangeHdr, resp.Header.Get("Content-Encoding"))
+		}
+		if body != c.body {
+			t.Errorf("%s %q: body %q, want %q", c.path, c.rangeHdr, body, c.body)
+		}
+	}
+	if n := sampled() - before; n != 0 {
+		t.Errorf("Learned from %d responses", n)
+	}
+
+	// The same client gets the complete page encoded
+	resp, _ := get("/page", "")
+	if resp.StatusCode != http.StatusOK || !encoded(resp.Header) {
+		t.Errorf("Complete page: status %d, Content-Encoding %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	if n := sampled() - before; n != 1 {
+		t.Errorf("Learned from %d complete pages, want 1", n)
+	}
+}
@@ -2,104 +2,92 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
-	"os"
-	"path"
-	"strings"
+	"net/url"
 	"time"
+
+	"github.com/rakoo/mmas/pkg/clients"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
 )
 
 var (
 	errNoChange = errors.New("No change")
 )
 
-func (bh *bodyHandler) makeDict(reqHost string) error {
+// makeDict builds a dictionary for the port reqURL was fetched on. Behind
+// MITM, the Host header has no port but the URL has the https scheme.
+func (bh *bodyHandler) makeDict(reqURL *url.URL) error {
+	if bh.Pinned() {
+		return nil
+	}
+
 	log.Println("Will make dict")
 	start := time.Now()
-	rows, err0 := bh.db.Query(`SELECT content FROM chunks ORDER BY count, content DESC`)
+	// Chunks seen by too few clients may be personal
+	rows, err0 := bh.db.Query(`SELECT content FROM chunks
+	WHERE `+clients.Enough+`
+	ORDER BY count, content DESC`, bh.config().Privacy.MinClients)
 	if err0 != nil {
 		return err0
 	}
 
-	var host, port string
-	// Assuming no ipv6 here
-	if strings.Contains(reqHost, ":") {
-		var err error
-		host, port, err = net.SplitHostPort(reqHost)
-		if err != nil {
-			return err
-		}
-	} else {
-		host = reqHost
-		port = "80"
-	}
+	port := sdch.URLPort(reqURL)
 
+	var size int64
 	err := func() error {
-		hash := sha256.New()
-
-		var headerBuf bytes.Buffer
-		headerMw := io.MultiWriter(&headerBuf, hash)
-		host = "reddit.com"
-		fmt.Fprintf(headerMw, "Domain: .%s\n", host)
-		fmt.Fprint(headerMw, "Path: /\n")
-		fmt.Fprint(headerMw, "Format-Version: 1.0\n")
-		fmt.Fprintf(headerMw, "Port: %s\n", port)
-		fmt.Fprint(headerMw, "Max-Age: 86400\n\n")
+		header := &sdch.Header{
+			Domain:        bh.config().Proxy.Domain,
+			Path:          "/",
+			FormatVersion: sdch.FormatVersion,
+			Ports:         []int{port},
+			MaxAge:        bh.config().Proxy.MaxAge.Duration,
+		}
+		rawHeader := header.Bytes()
 
 		var contentBuf bytes.Buffer
-		contentMw := io.MultiWriter(&contentBuf, hash)
 		for rows.Next() {
 			var content []byte
 			err := rows.Scan(&content)
 			if err != nil {
 				return err
 			}
-			_, err = contentMw.Write(content)
-			if err != nil {
-				return err
-			}
+			contentBuf.Write(content)
 		}
 
 		if err := rows.Err(); err != nil {
 			return err
 		}
 
-		hashHex := hex.EncodeToString(hash.Sum(nil))
-		newFileName := path.Join(DICT_PATH, hashHex)
-		if newFileName == bh.DictName() {
+		// No chunk was seen by enough clients yet: the next response
+		// will try again
+		if contentBuf.Len() == 0 {
 			return errNoChange
 		}
 
-		err := ioutil.WriteFile(newFileName, contentBuf.Bytes(), 0644)
-		if err != nil {
-			return err
+		if hex.EncodeToString(sdch.Hash(rawHeader, contentBuf.Bytes())) == bh.DictName() {
+			return errNoChange
 		}
-		newHdrFileName := path.Join(DICT_HDR_PATH, hashHex)
-		err = ioutil.WriteFile(newHdrFileName, headerBuf.Bytes(), 0644)
+
+		e, err := bh.store.Put(rawHeader, contentBuf.Bytes(), store.Meta{
+			Domain:  header.Domain,
+			Path:    header.Path,
+			Ports:   header.Ports,
+			Created: time.Now(),
+			MaxAge:  header.Age(),
+		})
 		if err != nil {
 			return err
 		}
 
-		oldName := bh.DictName()
-		bh.SetDictName(newFileName)
-		bh.SetDictHdrName(newHdrFileName)
-		if len(oldName) > 0 {
-			err := os.Remove(oldName)
-			if err != nil {
-				return err
-			}
-			err = os.Remove(path.Join(DICT_HDR_PATH, path.Base(oldName)))
-			if err != nil {
-				return err
-			}
+		// The previous dictionary is removed by the collector once its
+		// grace period is over
+		if err := bh.publish(&dictVersion{Entry: e}); err != nil {
+			return err
 		}
+		size = e.Size
 		return nil
 	}()
 
@@ -112,32 +100,6 @@ func (bh *bodyHandler) makeDict(reqHost string) error {
 		return err
 	}
 
-	st, err := os.Stat(bh.DictName())
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Generated a %d bytes dict in %f msecs\n", st.Size(), time.Since(start).Seconds()*1000)
+	log.Printf("Generated a %d bytes dict in %f msecs\n", size, time.Since(start).Seconds()*1000)
 	return nil
 }
-
-func (bh bodyHandler) makeSdchDict() (dict io.ReadSeeker, modTime time.Time, err error) {
-
-	dictHdr, err1 := os.Open(bh.DictHdrName())
-	dictContent, err2 := os.Open(bh.DictName())
-	if err1 != nil || err2 != nil {
-		return nil, time.Time{}, fmt.Errorf("Couldn't read files: %s -- %s", err1, err2)
-	}
-	st, err := dictContent.Stat()
-	if err != nil {
-		return nil, time.Time{}, err
-	}
-
-	var buf bytes.Buffer
-	io.Copy(&buf, dictHdr)
-	io.Copy(&buf, dictContent)
-	return bytes.NewReader(buf.Bytes()), st.ModTime(), nil
-}
-
-type sdchDictHeader struct {
-}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"camlistore.org/pkg/rollsum"
+	"github.com/rakoo/mmas/pkg/clients"
 )
 
 const (
@@ -19,7 +20,9 @@ const (
 	);`
 )
 
-func (bh *bodyHandler) parseResponse(body []byte) (changed bool, err error) {
+// parseResponse records the chunks of body, sent to the client with the
+// given id.
+func (bh *bodyHandler) parseResponse(body []byte, client []byte) (changed bool, err error) {
 
 	startParse := time.Now()
 
@@ -31,11 +34,18 @@ func (bh *bodyHandler) parseResponse(body []byte) (changed bool, err error) {
 	if err != nil {
 		return false, err
 	}
+	// Does nothing once committed
+	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(sqlUpSert)
 	if err != nil {
 		return false, err
 	}
+	clientStmt, err := tx.Prepare(clients.Add)
+	if err != nil {
+		return false, err
+	}
+	minClients := bh.config().Privacy.MinClients
 
 	known := 0
 	for {
@@ -49,13 +59,16 @@ func (bh *bodyHandler) parseResponse(body []byte) (changed bool, err error) {
 		}
 		rs.Roll(b)
 		buf = append(buf, b)
-		if rs.OnSplitWithBits(5) {
+		if rs.OnSplitWithBits(uint32(bh.config().Chunks.SplitBits)) {
 			h := sha1.Sum(buf)
 			var s int
 			bh.db.QueryRow(`SELECT LENGTH(content) FROM chunks WHERE hash = ?`, h[:]).Scan(&s)
 			known += s
 
 			_, err = stmt.Exec(buf, h[:], h[:])
+			if err == nil {
+				_, err = clientStmt.Exec(h[:], client, h[:], minClients)
+			}
 			if err != nil {
 				log.Println("HERE")
 				return false, err
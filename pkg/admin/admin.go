@@ -0,0 +1,209 @@
+// Package admin implements the authenticated admin API that both proxies
+// expose to inspect and override dictionary rotation.
+//
+// All calls need an "Authorization: Bearer <token>" header:
+//
+//	GET  <prefix>dicts            list the stored dictionaries
+//	GET  <prefix>vars             metrics, as published with expvar
+//	POST <prefix>pin              stop automatic rotation
+//	POST <prefix>unpin            resume automatic rotation
+//	POST <prefix>promote/<hash>   publish a stored dictionary and pin it
+//	POST <prefix>rollback         publish the previous dictionary and pin it
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+var (
+	ErrNoPrevious = errors.New("No previous dictionary")
+	ErrNoCurrent  = errors.New("No current dictionary")
+)
+
+// Dicts is what the proxies expose to the admin API.
+type Dicts interface {
+	// History lists the stored dictionaries, newest first
+	History() ([]store.Entry, error)
+
+	// Current is the hash of the advertised dictionary
+	Current() []byte
+
+	Pinned() bool
+
+	// SetPinned fails with ErrNoCurrent when pinning without an
+	// advertised dictionary
+	SetPinned(pinned bool) error
+
+	// Promote publishes the given stored dictionary. It pins it, or else
+	// the next rotation would replace it.
+	Promote(hash []byte) error
+}
+
+type historyEntry struct {
+	Hash    string    `json:"hash"`
+	Domain  string    `json:"domain"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	Current bool      `json:"current"`
+}
+
+type status struct {
+	Pinned  bool           `json:"pinned"`
+	Current string         `json:"current"`
+	History []historyEntry `json:"history"`
+}
+
+type handler struct {
+	prefix string
+	d      Dicts
+	token  string
+}
+
+// Handler serves the admin API under prefix. An empty token disables it.
+func Handler(prefix string, d Dicts, token string) http.Handler {
+	return handler{
+		prefix: prefix,
+		d:      d,
+		token:  token,
+	}
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, h.prefix)
+	if action == "dicts" {
+		if r.Method != "GET" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveStatus(w)
+		return
+	}
+	if action == "vars" {
+		if r.Method != "GET" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		expvar.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	switch {
+	case action == "pin":
+		err = h.d.SetPinned(true)
+	case action == "unpin":
+		err = h.d.SetPinned(false)
+	case action == "rollback":
+		err = h.rollback()
+	case strings.HasPrefix(action, "promote/"):
+		var hash []byte
+		hash, err = hex.DecodeString(strings.TrimPrefix(action, "promote/"))
+		if err != nil {
+			http.Error(w, "Invalid hash", http.StatusBadRequest)
+			return
+		}
+		err = h.d.Promote(hash)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch err {
+	case nil:
+		log.Printf("[ADMIN] %s done, current is %x\n", action, h.d.Current())
+		h.serveStatus(w)
+	case store.ErrNotFound, ErrNoPrevious, ErrNoCurrent:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Printf("[ADMIN] %s failed: %s\n", action, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (h handler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(h.token)) == 1
+}
+
+// rollback promotes the most recent dictionary older than the current one.
+func (h handler) rollback() error {
+	entries, err := h.d.History()
+	if err != nil {
+		return err
+	}
+
+	current := h.d.Current()
+	var currentEntry *store.Entry
+	for i := range entries {
+		if bytes.Equal(entries[i].Hash, current) {
+			currentEntry = &entries[i]
+			break
+		}
+	}
+	if currentEntry == nil {
+		return ErrNoPrevious
+	}
+
+	for _, e := range entries {
+		if e.Created.Before(currentEntry.Created) {
+			return h.d.Promote(e.Hash)
+		}
+	}
+	return ErrNoPrevious
+}
+
+func (h handler) serveStatus(w http.ResponseWriter) {
+	entries, err := h.d.History()
+	if err != nil {
+		log.Println("[ADMIN] Error listing dicts:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	current := hex.EncodeToString(h.d.Current())
+	st := status{
+		Pinned:  h.d.Pinned(),
+		Current: current,
+		History: make([]historyEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		st.History = append(st.History, historyEntry{
+			Hash:    e.Name(),
+			Domain:  e.Domain,
+			Path:    e.Path,
+			Size:    e.Size,
+			Created: e.Created,
+			Current: e.Name() == current,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(st)
+}
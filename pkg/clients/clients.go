@@ -0,0 +1,83 @@
+// Package clients counts the distinct clients each chunk was sent to, in
+// the sqlite database of the chunks, so that chunks only enter
+// dictionaries once enough clients have seen them. Clients are known by
+// their address, hashed with a salt kept in the database, so that
+// addresses are not stored as is.
+package clients
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"net"
+	"strconv"
+)
+
+const (
+	// Schema creates the tables, next to the chunks table
+	Schema = `
+	CREATE TABLE IF NOT EXISTS clients (
+		hash BLOB,
+		client BLOB,
+		UNIQUE (hash, client) ON CONFLICT IGNORE
+	);
+	CREATE TABLE IF NOT EXISTS salt (
+		id INTEGER PRIMARY KEY CHECK (id = 0),
+		salt BLOB
+	);`
+
+	// Add records that the chunk with the given hash was sent to a
+	// client. Its arguments are the hash, the client id, the hash again
+	// and the minimum number of clients: clients are only recorded until
+	// there are enough of them.
+	Add = `
+	INSERT INTO clients SELECT ?, ?
+	WHERE (SELECT COUNT(*) FROM clients WHERE hash = ?) < ?;`
+
+	// Count is, in a query of the chunks table, the number of clients
+	// each chunk was sent to.
+	Count = `(SELECT COUNT(*) FROM clients WHERE clients.hash = chunks.hash)`
+
+	// Enough is a condition on the chunks table, true for chunks sent to
+	// at least as many clients as its argument.
+	Enough = Count + ` >= ?`
+)
+
+// LoadSalt returns the salt client addresses are hashed with, and makes
+// it on the first run. It is kept so that clients are still recognized
+// after a restart.
+func LoadSalt(db *sql.DB) ([]byte, error) {
+	var salt []byte
+	err := db.QueryRow(`SELECT salt FROM salt WHERE id = 0`).Scan(&salt)
+	if err != sql.ErrNoRows {
+		return salt, err
+	}
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`INSERT INTO salt (id, salt) VALUES (0, ?)`, salt)
+	return salt, err
+}
+
+// Id is how the client at remoteAddr is known: its host, hashed with
+// salt.
+func Id(salt []byte, remoteAddr string) []byte {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(host))
+	return h.Sum(nil)[:8]
+}
+
+// Imported is the id of the i-th client of a chunk counted by another
+// instance, whose clients are not known here. Every import uses the same
+// ids, so that importing the same chunks again doesn't count their
+// clients twice.
+func Imported(i int) []byte {
+	h := sha256.Sum256([]byte("imported " + strconv.Itoa(i)))
+	return h[:8]
+}
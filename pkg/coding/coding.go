@@ -0,0 +1,197 @@
+// Package coding undoes and redoes the HTTP content codings upstreams may
+// apply to a response, so that the proxies learn from and encode the
+// actual content.
+package coding
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrUnsupported = errors.New("Unsupported content coding")
+)
+
+// Codings returns the content codings of a response, in the order they
+// were applied. identity is left out.
+func Codings(h http.Header) []string {
+	codings := make([]string, 0)
+	for _, line := range h["Content-Encoding"] {
+		for _, c := range strings.Split(line, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c == "" || c == "identity" {
+				continue
+			}
+			codings = append(codings, c)
+		}
+	}
+	return codings
+}
+
+// Supported is true when all of codings can be decoded and encoded.
+func Supported(codings []string) bool {
+	for _, c := range codings {
+		switch c {
+		case "gzip", "x-gzip", "deflate", "br", "zstd":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Decode undoes codings, the last applied first. It returns
+// ErrUnsupported if one of them is unknown.
+func Decode(body []byte, codings []string) ([]byte, error) {
+	if !Supported(codings) {
+		return nil, ErrUnsupported
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		body, err = decode(body, codings[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", codings[i], err)
+		}
+	}
+	return body, nil
+}
+
+// Encode applies codings in order.
+func Encode(body []byte, codings []string) ([]byte, error) {
+	if !Supported(codings) {
+		return nil, ErrUnsupported
+	}
+	for _, c := range codings {
+		var err error
+		body, err = encode(body, c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", c, err)
+		}
+	}
+	return body, nil
+}
+
+func decode(body []byte, coding string) ([]byte, error) {
+	var r io.Reader
+	switch coding {
+	case "gzip", "x-gzip":
+		gzr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		r = gzr
+	case "deflate":
+		// deflate is meant to be zlib-wrapped, but some servers send raw
+		// deflate
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(body))
+			defer fr.Close()
+			r = fr
+		} else {
+			defer zr.Close()
+			r = zr
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, ErrUnsupported
+	}
+	return ioutil.ReadAll(r)
+}
+
+func encode(body []byte, coding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, ErrUnsupported
+	}
+
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Preferred lists the codings the proxies compress their output with,
+// best first.
+var Preferred = []string{"br", "zstd", "gzip"}
+
+// Negotiate picks among offers the coding the client prefers according
+// to the Accept-Encoding headers of its request, with their q-values.
+// Ties go to the first offer. It returns "" when the client accepts none
+// of them.
+func Negotiate(h http.Header, offers ...string) string {
+	accepted := make(map[string]float64)
+	for _, line := range h["Accept-Encoding"] {
+		for _, each := range strings.Split(line, ",") {
+			params := strings.Split(each, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") {
+					continue
+				}
+				v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+			accepted[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, ok := accepted[offer]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
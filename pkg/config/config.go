@@ -0,0 +1,455 @@
+// Package config loads the TOML configuration shared by the MMAS
+// binaries: the forward proxy (mmas), the reverse proxy (server) and the
+// client proxy (client). Each binary only reads its own section, [chunks],
+// [privacy] and [sampling].
+//
+// Every key is optional, missing ones keep their default:
+//
+//	[chunks]
+//	split_bits = 5                   # chunks average 2^split_bits bytes
+//
+//	[privacy]                        # responses not learned from:
+//	skip_set_cookie = true           # setting a cookie
+//	skip_private = true              # Cache-Control private or no-store
+//	skip_authorization = true        # to requests with Authorization
+//	min_clients = 1                  # chunks enter dictionaries once seen
+//	                                 # by that many clients; raise it
+//	                                 # where there are many of them, such
+//	                                 # as on the server
+//
+//	[sampling]                       # responses learned from:
+//	rate = 1.0                       # share of them
+//	budget = "200ms"                 # time learning may take per second,
+//	                                 # rates adapt to it when set
+//
+//	[[sampling.rule]]                # first match overrides rate
+//	pattern = "/wiki/Special:"       # regexp of host and path
+//	rate = 0.1
+//
+//	[proxy]
+//	listen = ":8080"
+//	hosts = "reddit.com"             # regexp of the hosts to learn from
+//	database = "memory"              # sqlite file of the chunks
+//	dict_dir = "/var/tmp/mmas-dict/"
+//	domain = ".reddit.com"           # Domain of the dictionaries
+//	content_types = ["text/html"]
+//	max_age = "24h"
+//
+//	[server]
+//	listen = ":8080"
+//	data_dir = "."                   # each origin gets a directory in there
+//	domain = "localhost"             # Domain of origins routed by path
+//	content_types = ["text/html"]    # default for the origins
+//	max_age = "24h"
+//	queue_size = 256
+//	rebuild_interval = "30s"
+//	rebuild_batch = 100
+//
+//	[server.tls]
+//	listen = ":8443"                 # HTTPS is off without it
+//	cert = "cert.pem"                # self-signed and kept in data_dir
+//	key = "key.pem"                  # when not set
+//
+//	[[server.origin]]
+//	host = "en.example.com"          # either host...
+//	prefix = "/en/"                  # ... or path prefix
+//	url = "https://en.wikipedia.org/"
+//	name = "en"                      # defaults to host or prefix
+//	content_types = ["text/html"]
+//	cert = "en.pem"                  # picked by SNI, only with host
+//	key = "en-key.pem"
+//
+//	[client]
+//	listen = ":8081"
+//	dict_dir = "dicts"
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rakoo/mmas/pkg/sample"
+	"github.com/rakoo/mmas/pkg/sdch"
+)
+
+type Config struct {
+	Chunks   Chunks   `toml:"chunks"`
+	Privacy  Privacy  `toml:"privacy"`
+	Sampling Sampling `toml:"sampling"`
+	Proxy    Proxy    `toml:"proxy"`
+	Server   Server   `toml:"server"`
+	Client   Client   `toml:"client"`
+}
+
+type Chunks struct {
+	SplitBits int `toml:"split_bits"`
+}
+
+type Privacy struct {
+	SkipSetCookie     bool `toml:"skip_set_cookie"`
+	SkipPrivate       bool `toml:"skip_private"`
+	SkipAuthorization bool `toml:"skip_authorization"`
+	MinClients        int  `toml:"min_clients"`
+}
+
+// Rules are the responses not learned from.
+func (p Privacy) Rules() sdch.Privacy {
+	return sdch.Privacy{
+		SetCookie:     p.SkipSetCookie,
+		Private:       p.SkipPrivate,
+		Authorization: p.SkipAuthorization,
+	}
+}
+
+type Sampling struct {
+	Rate   float64        `toml:"rate"`
+	Budget Duration       `toml:"budget"`
+	Rules  []SamplingRule `toml:"rule"`
+}
+
+type SamplingRule struct {
+	Pattern string  `toml:"pattern"`
+	Rate    float64 `toml:"rate"`
+}
+
+// Sampler makes the sampler of the responses learned from, with its
+// counters published under name. The configuration must be valid.
+func (s Sampling) Sampler(name string) *sample.Sampler {
+	rules := make([]sample.Rule, 0, len(s.Rules))
+	for _, r := range s.Rules {
+		rules = append(rules, sample.Rule{
+			Pattern: regexp.MustCompile(r.Pattern),
+			Rate:    r.Rate,
+		})
+	}
+	return sample.New(name, s.Rate, rules, s.Budget.Duration)
+}
+
+type Proxy struct {
+	Listen       string   `toml:"listen"`
+	Hosts        string   `toml:"hosts"`
+	Database     string   `toml:"database"`
+	DictDir      string   `toml:"dict_dir"`
+	Domain       string   `toml:"domain"`
+	ContentTypes []string `toml:"content_types"`
+	MaxAge       Duration `toml:"max_age"`
+}
+
+type Server struct {
+	Listen          string   `toml:"listen"`
+	DataDir         string   `toml:"data_dir"`
+	Domain          string   `toml:"domain"`
+	ContentTypes    []string `toml:"content_types"`
+	MaxAge          Duration `toml:"max_age"`
+	QueueSize       int      `toml:"queue_size"`
+	RebuildInterval Duration `toml:"rebuild_interval"`
+	RebuildBatch    int      `toml:"rebuild_batch"`
+	TLS             TLS      `toml:"tls"`
+	Origins         []Origin `toml:"origin"`
+}
+
+type TLS struct {
+	Listen string `toml:"listen"`
+	Cert   string `toml:"cert"`
+	Key    string `toml:"key"`
+}
+
+type Origin struct {
+	Name         string   `toml:"name"`
+	Host         string   `toml:"host"`
+	Prefix       string   `toml:"prefix"`
+	URL          string   `toml:"url"`
+	ContentTypes []string `toml:"content_types"`
+	Cert         string   `toml:"cert"`
+	Key          string   `toml:"key"`
+}
+
+type Client struct {
+	Listen  string `toml:"listen"`
+	DictDir string `toml:"dict_dir"`
+}
+
+// Duration is a time.Duration written as "30s", "24h"...
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default is the configuration used when there is no file.
+func Default() *Config {
+	return &Config{
+		Chunks: Chunks{
+			SplitBits: 5,
+		},
+		Privacy: Privacy{
+			SkipSetCookie:     true,
+			SkipPrivate:       true,
+			SkipAuthorization: true,
+			MinClients:        1,
+		},
+		Sampling: Sampling{
+			Rate: 1,
+		},
+		Proxy: Proxy{
+			Listen:       ":8080",
+			Hosts:        "reddit.com",
+			Database:     "memory",
+			DictDir:      "/var/tmp/mmas-dict/",
+			Domain:       ".reddit.com",
+			ContentTypes: []string{"text/html"},
+			MaxAge:       Duration{24 * time.Hour},
+		},
+		Server: Server{
+			Listen:          ":8080",
+			DataDir:         ".",
+			Domain:          "localhost",
+			ContentTypes:    []string{"text/html"},
+			MaxAge:          Duration{24 * time.Hour},
+			QueueSize:       256,
+			RebuildInterval: Duration{30 * time.Second},
+			RebuildBatch:    100,
+		},
+		Client: Client{
+			Listen:  ":8081",
+			DictDir: "dicts",
+		},
+	}
+}
+
+// Load reads the configuration file at path over the defaults. An empty
+// path gives the defaults. Unknown keys are errors, so that typos don't
+// go unnoticed. The result still has to be validated, once command-line
+// overrides are applied.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path == "" {
+		return c, nil
+	}
+
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return nil, fmt.Errorf("%s: unknown keys %s", path, strings.Join(keys, ", "))
+	}
+	return c, nil
+}
+
+// validate checks the sections every binary reads.
+func (c *Config) validate() error {
+	if c.Chunks.SplitBits < 1 || c.Chunks.SplitBits > 30 {
+		return errors.New("chunks.split_bits must be between 1 and 30")
+	}
+	if c.Privacy.MinClients < 1 {
+		return errors.New("privacy.min_clients must be at least 1")
+	}
+	return c.Sampling.validate()
+}
+
+// ValidateProxy checks what the forward proxy reads.
+func (c *Config) ValidateProxy() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := checkListen("proxy.listen", c.Proxy.Listen); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(c.Proxy.Hosts); err != nil {
+		return fmt.Errorf("proxy.hosts: %s", err)
+	}
+	if c.Proxy.Database == "" || c.Proxy.DictDir == "" {
+		return errors.New("proxy.database and proxy.dict_dir can't be empty")
+	}
+	if c.Proxy.Domain == "" {
+		return errors.New("proxy.domain can't be empty")
+	}
+	if len(c.Proxy.ContentTypes) == 0 {
+		return errors.New("proxy.content_types can't be empty")
+	}
+	if c.Proxy.MaxAge.Duration <= 0 {
+		return errors.New("proxy.max_age must be positive")
+	}
+	return nil
+}
+
+// ValidateServer checks what the reverse proxy reads.
+func (c *Config) ValidateServer() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return c.Server.validate()
+}
+
+// ValidateClient checks what the client proxy reads.
+func (c *Config) ValidateClient() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if err := checkListen("client.listen", c.Client.Listen); err != nil {
+		return err
+	}
+	if c.Client.DictDir == "" {
+		return errors.New("client.dict_dir can't be empty")
+	}
+	return nil
+}
+
+func (s *Server) validate() error {
+	if err := checkListen("server.listen", s.Listen); err != nil {
+		return err
+	}
+	if s.Domain == "" {
+		return errors.New("server.domain can't be empty")
+	}
+	if s.MaxAge.Duration <= 0 || s.RebuildInterval.Duration <= 0 {
+		return errors.New("server.max_age and server.rebuild_interval must be positive")
+	}
+	if s.QueueSize <= 0 || s.RebuildBatch <= 0 {
+		return errors.New("server.queue_size and server.rebuild_batch must be positive")
+	}
+	if s.TLS.Listen != "" {
+		if err := checkListen("server.tls.listen", s.TLS.Listen); err != nil {
+			return err
+		}
+	}
+	if (s.TLS.Cert == "") != (s.TLS.Key == "") {
+		return errors.New("server.tls.cert and server.tls.key go together")
+	}
+
+	names := make(map[string]bool)
+	routes := make(map[string]bool)
+	for i := range s.Origins {
+		o := &s.Origins[i]
+		if len(o.ContentTypes) == 0 {
+			o.ContentTypes = s.ContentTypes
+		}
+		if err := o.normalize(); err != nil {
+			return fmt.Errorf("server.origin %d: %s", i+1, err)
+		}
+		if names[o.Name] {
+			return fmt.Errorf("server.origin %d: duplicate name %q", i+1, o.Name)
+		}
+		names[o.Name] = true
+		route := o.Host + o.Prefix
+		if routes[route] {
+			return fmt.Errorf("server.origin %d: %q is already routed", i+1, route)
+		}
+		routes[route] = true
+	}
+	return nil
+}
+
+func (s *Sampling) validate() error {
+	if s.Rate < 0 || s.Rate > 1 {
+		return errors.New("sampling.rate must be between 0 and 1")
+	}
+	if s.Budget.Duration < 0 {
+		return errors.New("sampling.budget can't be negative")
+	}
+	for i, r := range s.Rules {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("sampling.rule %d: %s", i+1, err)
+		}
+		if r.Rate < 0 || r.Rate > 1 {
+			return fmt.Errorf("sampling.rule %d: rate must be between 0 and 1", i+1)
+		}
+	}
+	return nil
+}
+
+// normalize checks an origin and fills its derived fields.
+func (o *Origin) normalize() error {
+	if (o.Host == "") == (o.Prefix == "") {
+		return errors.New("exactly one of host and prefix must be set")
+	}
+	if o.Prefix != "" {
+		if !strings.HasPrefix(o.Prefix, "/") {
+			return errors.New("prefix must start with /")
+		}
+		o.Prefix = strings.TrimSuffix(o.Prefix, "/") + "/"
+	}
+	o.Host = strings.ToLower(o.Host)
+
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return errors.New("url must be absolute")
+	}
+	if len(o.ContentTypes) == 0 {
+		return errors.New("content_types can't be empty")
+	}
+	if (o.Cert == "") != (o.Key == "") {
+		return errors.New("cert and key go together")
+	}
+	if o.Cert != "" && o.Host == "" {
+		return errors.New("cert needs host, certificates are selected by SNI")
+	}
+
+	if o.Name == "" {
+		o.Name = o.Host
+		if o.Name == "" {
+			// "/a/b/" is named "a-b"
+			o.Name = strings.Replace(strings.Trim(o.Prefix, "/"), "/", "-", -1)
+		}
+		if o.Name == "" {
+			o.Name = "default"
+		}
+	}
+	if strings.ContainsAny(o.Name, "/\\") || o.Name == "." || o.Name == ".." {
+		return fmt.Errorf("invalid name %q", o.Name)
+	}
+	return nil
+}
+
+// MatchContentType is true when contentType, parameters aside, is one of
+// types.
+func MatchContentType(types []string, contentType string) bool {
+	for _, typ := range types {
+		if contentType == typ || strings.HasPrefix(contentType, typ+";") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkListen(key, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+	return nil
+}
+
+// Port is the port of a listen address.
+func Port(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return 0
+	}
+	return p
+}
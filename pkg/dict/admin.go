@@ -0,0 +1,79 @@
+package dict
+
+import (
+	"log"
+
+	"github.com/rakoo/mmas/pkg/admin"
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+// History lists the stored dictionaries, newest first.
+func (d *Dict) History() ([]store.Entry, error) {
+	return d.store.List()
+}
+
+// Current is the hash of the published dictionary, or nil.
+func (d *Dict) Current() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sdchFullHash
+}
+
+func (d *Dict) Pinned() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pinned
+}
+
+// SetPinned stops or resumes automatic rotation of the dictionary.
+func (d *Dict) SetPinned(pinned bool) error {
+	var err error
+	if pinned {
+		if d.Current() == nil {
+			return admin.ErrNoCurrent
+		}
+		_, err = d.db.Exec(`INSERT OR REPLACE INTO pinned (id) VALUES (0)`)
+	} else {
+		_, err = d.db.Exec(`DELETE FROM pinned`)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.pinned = pinned
+	d.mu.Unlock()
+	return nil
+}
+
+// Promote publishes a stored dictionary and pins it.
+func (d *Dict) Promote(hash []byte) error {
+	dict, err := d.store.Get(hash)
+	if err != nil {
+		return err
+	}
+
+	// We don't know which chunks the dictionary was built from: once
+	// unpinned, the next rebuild will replace it
+	err = d.save(dict.Hash, dict.Header, nil)
+	if err != nil {
+		return err
+	}
+	if err := d.retire(dict.Entry); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.sdchDictChunks = nil
+	d.SdchHeader = dict.Header
+	d.sdchFullHash = dict.Hash
+	d.mu.Unlock()
+
+	// Only pinned once published, so that a failure leaves rotation on
+	if err := d.SetPinned(true); err != nil {
+		return err
+	}
+
+	log.Printf("Promoted dict %x\n", dict.Hash)
+	return nil
+}
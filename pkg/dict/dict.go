@@ -3,21 +3,23 @@ package dict
 import (
 	"bytes"
 	"crypto/sha1"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"expvar"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"os"
-	"os/exec"
-	"path"
+	"net/http"
 	"sort"
+	"sync"
+	"time"
 
 	"camlistore.org/pkg/rollsum"
+	"github.com/rakoo/mmas/pkg/clients"
+	"github.com/rakoo/mmas/pkg/sample"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
+	"github.com/rakoo/mmas/pkg/vcdiff"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -36,20 +38,64 @@ var (
 )
 
 type Dict struct {
-	db *sql.DB
+	db    *sql.DB
+	store *store.Store
 
+	// Only used by the scheduler, which gets new ones through options;
+	// fixed is what the Dict was opened with
+	opts    Options
+	options chan Options
+	fixed   Options
+
+	// Protects the published dictionary
+	mu             sync.Mutex
 	sdchDictChunks [][]byte
 	sdchFullHash   []byte
+	published      store.Entry
+
+	// Dictionaries still used by clients, most recently retired first
+	retired []retiredEntry
+
+	// When pinned, the dictionary is not rotated anymore
+	pinned bool
+
+	// Picks the responses learned from; it changes on reload
+	sampler *sample.Sampler
+
+	// Responses waiting to be parsed by the scheduler
+	queue chan response
+
+	// Closed to stop the scheduler, and by the scheduler once stopped
+	quit chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
 
 	// stats
 	totalBytesDup uint64
 	totalBytesIn  uint64
 
+	// Published with expvar
+	parsed  *expvar.Int
+	dropped *expvar.Int
+
 	SdchHeader []byte
+
+	// Hashes client addresses
+	salt []byte
+}
+
+// A response to learn from, and the client it was sent to
+type response struct {
+	content []byte
+	client  []byte
 }
 
-func New() (*Dict, error) {
-	db, err := sql.Open("sqlite3", "dict")
+func New(opts Options) (*Dict, error) {
+	opts.setDefaults()
+
+	db, err := sql.Open("sqlite3", opts.DBPath)
 	if err != nil {
 		return nil, err
 	}
@@ -64,159 +110,326 @@ CREATE TABLE IF NOT EXISTS chunks (
 		content BLOB,
 		hash BLOB UNIQUE ON CONFLICT REPLACE,
 		count INTEGER
-);`)
+);
+CREATE TABLE IF NOT EXISTS dictionary (
+		id INTEGER PRIMARY KEY CHECK (id = 0),
+		hash BLOB,
+		header BLOB,
+		chunks BLOB
+);
+CREATE TABLE IF NOT EXISTS pinned (
+		id INTEGER PRIMARY KEY CHECK (id = 0)
+);
+CREATE TABLE IF NOT EXISTS retired (
+		hash BLOB PRIMARY KEY,
+		retired INTEGER
+);
+` + clients.Schema)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Dict{
-		db: db,
-	}, nil
-}
+	salt, err := clients.LoadSalt(db)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := store.Open(opts.StoreDir)
+	if err != nil {
+		return nil, err
+	}
 
-func (d *Dict) UserAgentId() []byte {
-	if len(d.sdchFullHash) == 0 {
-		return []byte{}
+	d := &Dict{
+		db:      db,
+		store:   st,
+		opts:    opts,
+		options: make(chan Options),
+		fixed:   opts,
+		queue:   make(chan response, opts.QueueSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		salt:    salt,
+	}
+	d.parsed, d.dropped = counters(opts.Name)
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.loadRetired(); err != nil {
+		return nil, err
+	}
+	if err := d.cleanup(); err != nil {
+		return nil, err
 	}
-	return based(d.sdchFullHash[6:12])
+
+	go d.schedule()
+	return d, nil
 }
 
-func (d *Dict) ServerId() []byte {
-	if len(d.sdchFullHash) == 0 {
-		return []byte{}
+// load restores the active dictionary saved by a previous run, so that
+// clients still holding it keep getting compressed responses.
+func (d *Dict) load() error {
+	var hash, header, chunks []byte
+	err := d.db.QueryRow(`SELECT hash, header, chunks FROM dictionary WHERE id = 0`).Scan(&hash, &header, &chunks)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e, err := d.store.Entry(hash)
+	if err != nil {
+		log.Printf("Not restoring dict %x: %s\n", hash, err)
+		return nil
+	}
+	d.published = e
+
+	d.sdchDictChunks = make([][]byte, 0, len(chunks)/sha1.Size)
+	for len(chunks) >= sha1.Size {
+		d.sdchDictChunks = append(d.sdchDictChunks, chunks[:sha1.Size])
+		chunks = chunks[sha1.Size:]
+	}
+	d.sdchFullHash = hash
+	d.SdchHeader = header
+
+	var pinned int
+	err = d.db.QueryRow(`SELECT COUNT(*) FROM pinned`).Scan(&pinned)
+	if err != nil {
+		return err
 	}
-	return based(d.sdchFullHash[:6])
+	d.pinned = pinned > 0
+
+	log.Printf("Restored dict %x (pinned: %t)\n", hash, d.pinned)
+	return nil
 }
 
-func based(in []byte) []byte {
-	dst := make([]byte, base64.URLEncoding.EncodedLen(len(in)))
-	base64.URLEncoding.Encode(dst, in)
-	return dst
+// save persists the active dictionary metadata. It acts as the manifest
+// of the dictionary: it is written last, once the content is on disk.
+func (d *Dict) save(hash, header []byte, chunkHashes [][]byte) error {
+	chunks := make([]byte, 0, len(chunkHashes)*sha1.Size)
+	for _, h := range chunkHashes {
+		chunks = append(chunks, h...)
+	}
+	_, err := d.db.Exec(`INSERT OR REPLACE INTO dictionary (id, hash, header, chunks) VALUES (0, ?, ?, ?)`,
+		hash, header, chunks)
+	return err
 }
 
-func (d *Dict) DictName() string {
-	return hex.EncodeToString(d.sdchFullHash)
+// UserAgentId is the id clients send in Avail-Dictionary when they hold
+// the published dictionary, or "" if there is none.
+func (d *Dict) UserAgentId() string {
+	return sdch.UserAgentId(d.Current())
 }
 
-func (d *Dict) Eat(content []byte) (diff []byte, err error) {
+// ServerId is the id sent in front of responses encoded with the
+// published dictionary, or "" if there is none.
+func (d *Dict) ServerId() string {
+	return sdch.ServerId(d.Current())
+}
 
-	go func() {
-		err := d.parse(content)
-		if err != nil {
-			log.Println("Error parsing:", err)
-		}
-	}()
+// Store is where the dictionaries are kept.
+func (d *Dict) Store() *store.Store {
+	return d.store
+}
 
-	if len(d.SdchHeader) == 0 {
-		return nil, ErrNoDict
+// Manifest describes the dictionaries that are served: the published one
+// first, then the others, most recently retired first. Retired ones
+// expire Max-Age after their retirement.
+func (d *Dict) Manifest() ([]store.ManifestEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.published.Hash) == 0 {
+		return []store.ManifestEntry{}, nil
 	}
 
-	dictpath := path.Join("dicts", hex.EncodeToString(d.sdchFullHash))
-	var diffBuf bytes.Buffer
-	cmd := exec.Command("vcdiff", "delta", "-dictionary", dictpath, "-interleaved", "-stats", "-checksum")
-	cmd.Stdin = bytes.NewReader(content)
-	cmd.Stdout = &diffBuf
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return nil, err
+	manifest := make([]store.ManifestEntry, 0, len(d.retired)+1)
+	manifest = append(manifest, store.NewManifestEntry(d.published, nil))
+	for _, r := range d.retired {
+		expires := r.expires()
+		manifest = append(manifest, store.NewManifestEntry(r.Entry, &expires))
 	}
-	diff = diffBuf.Bytes()
-
-	return diff, nil
+	return manifest, nil
 }
 
-func (d *Dict) parse(content []byte) error {
-	rs := rollsum.New()
+func (d *Dict) DictName() string {
+	return hex.EncodeToString(d.Current())
+}
 
-	var match uint64
-	q := content
-	buf := make([]byte, 0)
-	hashes := make([][]byte, 0)
-	offs := make([]int, 0)
+// Choose returns the hash of the best dictionary among the ones the
+// client holds, given by their user agent ids: the published one if
+// possible, or else the newest one clients may still use. It returns nil
+// if none is usable.
+func (d *Dict) Choose(uaIds []string) []byte {
+	held := make(map[string]bool, len(uaIds))
+	for _, id := range uaIds {
+		held[id] = true
+	}
 
-	tx, err := d.db.Begin()
-	if err != nil {
-		return err
+	current := d.Current()
+	if len(current) > 0 && held[sdch.UserAgentId(current)] {
+		return current
 	}
 
-	stmt, err := tx.Prepare(sqlUpSert)
+	manifest, err := d.Manifest()
 	if err != nil {
-		return err
+		log.Println("Error listing dicts:", err)
+		return nil
 	}
+	now := time.Now()
+	for _, m := range manifest {
+		if !held[m.UserAgentId] || m.Advertised || !m.Expires.After(now) {
+			continue
+		}
+		hash, err := hex.DecodeString(m.Hash)
+		if err != nil {
+			continue
+		}
+		return hash
+	}
+	return nil
+}
 
-	off := 0
-	for len(q) > 0 {
-		b := q[0]
-		q = q[1:]
+// SetSampler makes s pick the responses learned from. Without a sampler,
+// all of them are.
+func (d *Dict) SetSampler(s *sample.Sampler) {
+	d.mu.Lock()
+	d.sampler = s
+	d.mu.Unlock()
+}
 
-		rs.Roll(b)
-		off++
-		d.totalBytesIn++
+func (d *Dict) getSampler() *sample.Sampler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sampler
+}
 
-		buf = append(buf, b)
-		if rs.OnSplitWithBits(5) {
-			h := sha1.Sum(buf)
-			offs = append(offs, off)
-			hashes = append(hashes, h[:])
+// Eat learns from content, the response to req, if it is sampled, then
+// encodes it against the dictionary with the given hash, as returned by
+// Choose.
+func (d *Dict) Eat(content []byte, req *http.Request, hash []byte) (diff []byte, err error) {
+	if d.getSampler().Sample(req.Host + req.URL.RequestURI()) {
+		d.ingest(response{content, clients.Id(d.salt, req.RemoteAddr)})
+	}
+	return d.Encode(content, hash)
+}
 
-			_, err := stmt.Exec(buf, h[:], h[:])
-			if err != nil {
-				return err
-			}
-			buf = buf[:0]
-		}
+// Encode encodes content against the dictionary with the given hash,
+// without learning from it.
+func (d *Dict) Encode(content []byte, hash []byte) (diff []byte, err error) {
+	if len(hash) == 0 {
+		return nil, ErrNoDict
 	}
 
-	d.totalBytesDup += uint64(match)
+	return vcdiff.Delta(d.store.ContentPath(hash), content)
+}
 
-	if errStmt := stmt.Close(); errStmt != nil {
+// parse chunks a batch of responses and records the chunks, in a single
+// transaction.
+func (d *Dict) parse(batch []response) error {
+	tx, err := d.db.Begin()
+	if err != nil {
 		return err
 	}
 
-	if errTx := tx.Commit(); errTx != nil {
+	stmt, err := tx.Prepare(sqlUpSert)
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
-
-	err = d.makeDict()
+	clientStmt, err := tx.Prepare(clients.Add)
 	if err != nil {
+		stmt.Close()
+		tx.Rollback()
 		return err
 	}
 
-	return nil
+	for _, resp := range batch {
+		rs := rollsum.New()
+		buf := make([]byte, 0)
+
+		for _, b := range resp.content {
+			rs.Roll(b)
+			d.totalBytesIn++
+
+			buf = append(buf, b)
+			if rs.OnSplitWithBits(uint32(d.opts.SplitBits)) {
+				h := sha1.Sum(buf)
+				_, err := stmt.Exec(buf, h[:], h[:])
+				if err == nil {
+					_, err = clientStmt.Exec(h[:], resp.client, h[:], d.opts.MinClients)
+				}
+				if err != nil {
+					clientStmt.Close()
+					stmt.Close()
+					tx.Rollback()
+					return err
+				}
+				buf = buf[:0]
+			}
+		}
+	}
+
+	clientStmt.Close()
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (d *Dict) makeDict() error {
+	if d.Pinned() {
+		return nil
+	}
+
 	contents, hashes, change := d.needToUpdate()
 	if change {
 		log.Println("Changing dict")
-		d.sdchDictChunks = hashes
-
-		hash := sha256.New()
-		var buf bytes.Buffer
-		mw := io.MultiWriter(&buf, hash)
-		fmt.Fprint(mw, "Domain: localhost\n")
-		fmt.Fprint(mw, "Path: /\n")
-		fmt.Fprint(mw, "Format-Version: 1.0\n")
-		fmt.Fprint(mw, "Port: 8080\n")
-		fmt.Fprint(mw, "Max-Age: 86400\n\n")
-
-		d.SdchHeader = buf.Bytes()
 
-		hash.Write(contents)
-		h := hash.Sum(nil)
-		d.sdchFullHash = hash.Sum(nil)
+		header := &sdch.Header{
+			Domain:        d.opts.Domain,
+			Path:          d.opts.Path,
+			FormatVersion: sdch.FormatVersion,
+			Ports:         d.opts.Ports,
+			MaxAge:        d.opts.MaxAge,
+		}
+		rawHeader := header.Bytes()
+
+		// Dictionary first, then our metadata: the dictionary is only
+		// published once both are on disk
+		e, err := d.store.Put(rawHeader, contents, store.Meta{
+			Domain:  header.Domain,
+			Path:    header.Path,
+			Ports:   header.Ports,
+			Created: time.Now(),
+			MaxAge:  header.Age(),
+		})
+		if err != nil {
+			return err
+		}
 
-		dictpath := path.Join("dicts", hex.EncodeToString(h))
-		err := ioutil.WriteFile(dictpath, contents, 0644)
+		err = d.save(e.Hash, rawHeader, hashes)
 		if err != nil {
 			return err
 		}
+		if err := d.retire(e); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		d.sdchDictChunks = hashes
+		d.SdchHeader = rawHeader
+		d.sdchFullHash = e.Hash
+		d.mu.Unlock()
 	}
 	return nil
 }
 
 func (d *Dict) needToUpdate() (contents []byte, hashes [][]byte, change bool) {
-	rows, err := d.db.Query(`SELECT hash, content FROM chunks WHERE COUNT > 1 ORDER BY count, hash DESC`)
+	rows, err := d.db.Query(`SELECT hash, content FROM chunks
+	WHERE count > 1 AND `+clients.Enough+`
+	ORDER BY count, hash DESC`, d.opts.MinClients)
 	if err != nil {
 		log.Println(err)
 		return nil, nil, false
@@ -238,16 +451,24 @@ func (d *Dict) needToUpdate() (contents []byte, hashes [][]byte, change bool) {
 		return nil, nil, false
 	}
 
+	// Nothing was seen by enough clients yet
+	if len(hashes) == 0 {
+		return nil, nil, false
+	}
+
 	sort.Sort(sliceslice(hashes))
-	if d.sdchDictChunks == nil || len(d.sdchDictChunks) == 0 {
+	d.mu.Lock()
+	current := d.sdchDictChunks
+	d.mu.Unlock()
+	if len(current) == 0 {
 		return contents, hashes, true
 	}
 
 	var uniq int
 	for _, newHash := range hashes {
 		var exactMatch bool
-		sort.Search(len(d.sdchDictChunks), func(i int) bool {
-			cmp := bytes.Compare(d.sdchDictChunks[i], newHash)
+		sort.Search(len(current), func(i int) bool {
+			cmp := bytes.Compare(current[i], newHash)
 			if cmp == 0 {
 				exactMatch = true
 			}
@@ -259,13 +480,13 @@ func (d *Dict) needToUpdate() (contents []byte, hashes [][]byte, change bool) {
 		}
 	}
 
-	ratio := float64(uniq) / float64(len(d.sdchDictChunks))
-	log.Printf("Got %d uniques out of %d (%f%%)", uniq, len(d.sdchDictChunks), 100*ratio)
+	ratio := float64(uniq) / float64(len(current))
+	log.Printf("Got %d uniques out of %d (%f%%)", uniq, len(current), 100*ratio)
 	return contents, hashes, ratio > float64(0.1)
 }
 
 func (d *Dict) Stats() string {
-	return fmt.Sprintf("matched %d out of %d", d.totalBytesDup, d.totalBytesIn)
+	return fmt.Sprintf("matched %d out of %d, dropped %d responses", d.totalBytesDup, d.totalBytesIn, d.dropped.Value())
 }
 
 type sliceslice [][]byte
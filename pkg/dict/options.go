@@ -0,0 +1,81 @@
+package dict
+
+import (
+	"time"
+)
+
+// Options configures a Dict. The zero value of each field means its
+// default.
+type Options struct {
+	// Name the metrics are published under, DBPath by default
+	Name string
+
+	// sqlite database holding the chunks, "dict" by default
+	DBPath string
+
+	// Directory of the dictionary store, "dicts" by default
+	StoreDir string
+
+	// Scope of the dictionaries, "localhost", "/" and 8080 by default
+	Domain string
+	Path   string
+	Ports  []int
+
+	// How long clients may use a dictionary, one day by default
+	MaxAge time.Duration
+
+	// Chunks average 2^SplitBits bytes, 5 by default
+	SplitBits int
+
+	// Number of responses waiting to be parsed before new ones are
+	// dropped
+	QueueSize int
+
+	// The dictionary is rebuilt at most every RebuildInterval, unless
+	// RebuildBatch new responses were parsed in the meantime
+	RebuildInterval time.Duration
+	RebuildBatch    int
+
+	// Chunks only enter the dictionary once sent to that many distinct
+	// clients, 1 by default
+	MinClients int
+}
+
+func (o *Options) setDefaults() {
+	if o.DBPath == "" {
+		o.DBPath = "dict"
+	}
+	if o.Name == "" {
+		o.Name = o.DBPath
+	}
+	if o.StoreDir == "" {
+		o.StoreDir = "dicts"
+	}
+	if o.Domain == "" {
+		o.Domain = "localhost"
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if len(o.Ports) == 0 {
+		o.Ports = []int{8080}
+	}
+	if o.MaxAge == 0 {
+		o.MaxAge = 24 * time.Hour
+	}
+	if o.SplitBits == 0 {
+		o.SplitBits = 5
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = queueSize
+	}
+	if o.RebuildInterval == 0 {
+		o.RebuildInterval = rebuildInterval
+	}
+	if o.RebuildBatch == 0 {
+		o.RebuildBatch = rebuildBatch
+	}
+	if o.MinClients == 0 {
+		o.MinClients = 1
+	}
+}
@@ -0,0 +1,149 @@
+package dict
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+// retiredEntry is a stored dictionary that is not advertised anymore.
+// Clients may have fetched it right before, so it is still used for
+// encoding until its Max-Age after its retirement.
+type retiredEntry struct {
+	store.Entry
+	retired time.Time
+}
+
+func (r retiredEntry) expires() time.Time {
+	return r.retired.Add(r.MaxAge)
+}
+
+// retire records that the published dictionary stops being advertised in
+// favor of next, which may be a retired one being promoted again.
+func (d *Dict) retire(next store.Entry) error {
+	now := time.Now()
+	d.mu.Lock()
+	prev := d.published
+	d.mu.Unlock()
+
+	if len(prev.Hash) > 0 && !bytes.Equal(prev.Hash, next.Hash) {
+		_, err := d.db.Exec(`INSERT OR REPLACE INTO retired (hash, retired) VALUES (?, ?)`,
+			prev.Hash, now.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := d.db.Exec(`DELETE FROM retired WHERE hash = ?`, next.Hash); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	retired := make([]retiredEntry, 0, len(d.retired)+1)
+	if len(prev.Hash) > 0 && !bytes.Equal(prev.Hash, next.Hash) {
+		retired = append(retired, retiredEntry{Entry: prev, retired: now})
+	}
+	for _, r := range d.retired {
+		if !bytes.Equal(r.Hash, next.Hash) && !bytes.Equal(r.Hash, prev.Hash) {
+			retired = append(retired, r)
+		}
+	}
+	sort.Sort(byRetiredInv(retired))
+	d.retired = retired
+	d.published = next
+	return nil
+}
+
+// loadRetired restores the retired dictionaries, from the store and the
+// retirements recorded in the database. Stored dictionaries without one,
+// as left by previous versions, are considered retired when their
+// successor was created.
+func (d *Dict) loadRetired() error {
+	entries, err := d.store.List()
+	if err != nil {
+		return err
+	}
+	rows, err := d.db.Query(`SELECT hash, retired FROM retired`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	retirements := make(map[string]time.Time)
+	for rows.Next() {
+		var hash []byte
+		var at int64
+		if err := rows.Scan(&hash, &at); err != nil {
+			return err
+		}
+		retirements[hex.EncodeToString(hash)] = time.Unix(at, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	current := d.Current()
+	retired := make([]retiredEntry, 0, len(entries))
+	for i, e := range entries {
+		if bytes.Equal(e.Hash, current) {
+			continue
+		}
+		at, ok := retirements[e.Name()]
+		if !ok {
+			at = time.Now()
+			if i > 0 {
+				at = entries[i-1].Created
+			}
+			_, err := d.db.Exec(`INSERT OR REPLACE INTO retired (hash, retired) VALUES (?, ?)`,
+				e.Hash, at.Unix())
+			if err != nil {
+				return err
+			}
+		}
+		retired = append(retired, retiredEntry{Entry: e, retired: at})
+	}
+	sort.Sort(byRetiredInv(retired))
+
+	d.mu.Lock()
+	d.retired = retired
+	d.mu.Unlock()
+	return nil
+}
+
+// cleanup removes from the store the dictionaries that nobody should be
+// using anymore.
+func (d *Dict) cleanup() error {
+	now := time.Now()
+	var expired []retiredEntry
+	d.mu.Lock()
+	kept := d.retired[:0]
+	for _, r := range d.retired {
+		if r.expires().After(now) {
+			kept = append(kept, r)
+		} else {
+			expired = append(expired, r)
+		}
+	}
+	d.retired = kept
+	d.mu.Unlock()
+
+	for _, r := range expired {
+		log.Println("Removing expired dict", r.Name())
+		if err := d.store.Delete(r.Hash); err != nil {
+			return err
+		}
+		if _, err := d.db.Exec(`DELETE FROM retired WHERE hash = ?`, r.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type byRetiredInv []retiredEntry
+
+func (br byRetiredInv) Len() int           { return len(br) }
+func (br byRetiredInv) Less(i, j int) bool { return br[i].retired.After(br[j].retired) }
+func (br byRetiredInv) Swap(i, j int)      { br[i], br[j] = br[j], br[i] }
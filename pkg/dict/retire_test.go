@@ -0,0 +1,78 @@
+package dict
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+func TestExpiredRemovedWhileRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmas-dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldInterval := cleanupInterval
+	cleanupInterval = 10 * time.Millisecond
+	defer func() { cleanupInterval = oldInterval }()
+
+	d, err := New(Options{
+		DBPath:   path.Join(dir, "dict"),
+		StoreDir: path.Join(dir, "dicts"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	put := func(content string) []byte {
+		e, err := d.Store().Put([]byte("Domain: localhost\n\n"), []byte(content), store.Meta{
+			Domain:  "localhost",
+			Path:    "/",
+			Created: time.Now(),
+			MaxAge:  50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.Hash
+	}
+	old, next := put("old dictionary"), put("next dictionary")
+	if err := d.Promote(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Promote(next); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := d.Store().Entry(old)
+		if err == store.ErrNotFound {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Retired dictionary still stored after its grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	manifest, err := d.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 {
+		t.Errorf("Manifest lists %d dictionaries, want the published one only", len(manifest))
+	}
+	if _, err := d.Store().Entry(next); err != nil {
+		t.Errorf("Published dictionary: %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package dict
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// Defaults of the scheduling Options
+const (
+	queueSize       = 256
+	rebuildInterval = 30 * time.Second
+	rebuildBatch    = 100
+)
+
+// How often expired dictionaries are looked for
+var cleanupInterval = 1 * time.Minute
+
+var (
+	metrics   = expvar.NewMap("dict")
+	metricsMu sync.Mutex
+)
+
+// counters returns the counters of the responses parsed and dropped by
+// the Dicts with the given name. They are published under "dict", and
+// survive the Dict being reopened.
+func counters(name string) (parsed, dropped *expvar.Int) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	vars, ok := metrics.Get(name).(*expvar.Map)
+	if !ok {
+		vars = new(expvar.Map).Init()
+		vars.Set("parsed", new(expvar.Int))
+		vars.Set("dropped", new(expvar.Int))
+		metrics.Set(name, vars)
+	}
+	return vars.Get("parsed").(*expvar.Int), vars.Get("dropped").(*expvar.Int)
+}
+
+// ingest hands content over to the scheduler. It never blocks: if the
+// scheduler is lagging behind, the content is dropped.
+func (d *Dict) ingest(resp response) {
+	select {
+	case d.queue <- resp:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// schedule parses queued responses in batches and rebuilds the dictionary
+// when enough of them were parsed or enough time has passed. It also
+// removes the expired dictionaries. There is one scheduler per Dict, so
+// there is never more than one rebuild at a time.
+func (d *Dict) schedule() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.opts.RebuildInterval)
+	defer func() { ticker.Stop() }()
+	cleanupTicker := time.NewTicker(cleanupInterval)
+	defer cleanupTicker.Stop()
+
+	pending := 0
+	for {
+		select {
+		case <-d.quit:
+			// Whatever is still queued is parsed, but a rebuild would
+			// delay the shutdown too much: the next run will do it
+			select {
+			case resp := <-d.queue:
+				if err := d.parse(d.drain(resp)); err != nil {
+					log.Println("Error parsing:", err)
+				}
+			default:
+			}
+			return
+		case opts := <-d.options:
+			if opts.RebuildInterval != d.opts.RebuildInterval {
+				ticker.Stop()
+				ticker = time.NewTicker(opts.RebuildInterval)
+			}
+			d.opts = opts
+			continue
+		case resp := <-d.queue:
+			batch := d.drain(resp)
+			start := time.Now()
+			err := d.parse(batch)
+			d.getSampler().Spent(time.Since(start))
+			if err != nil {
+				log.Println("Error parsing:", err)
+				continue
+			}
+			d.parsed.Add(int64(len(batch)))
+			pending += len(batch)
+			if pending < d.opts.RebuildBatch {
+				continue
+			}
+		case <-cleanupTicker.C:
+			if err := d.cleanup(); err != nil {
+				log.Println("Error removing expired dicts:", err)
+			}
+			continue
+		case <-ticker.C:
+			if pending == 0 {
+				continue
+			}
+		}
+
+		if err := d.makeDict(); err != nil {
+			log.Println("Error making dict:", err)
+		}
+		pending = 0
+	}
+}
+
+// SetOptions changes the options of a running Dict, from its next batch
+// on. DBPath, StoreDir, Name and QueueSize are kept as the Dict was opened
+// with.
+func (d *Dict) SetOptions(opts Options) {
+	opts.setDefaults()
+	opts.DBPath = d.fixed.DBPath
+	opts.StoreDir = d.fixed.StoreDir
+	opts.Name = d.fixed.Name
+	opts.QueueSize = d.fixed.QueueSize
+	select {
+	case d.options <- opts:
+	case <-d.done:
+	}
+}
+
+// drain returns first along with everything else currently queued.
+func (d *Dict) drain(first response) []response {
+	batch := []response{first}
+	for {
+		select {
+		case resp := <-d.queue:
+			batch = append(batch, resp)
+		default:
+			return batch
+		}
+	}
+}
+
+// Close stops the scheduler once the queued responses are parsed and the
+// dictionary being built, if any, is published, then closes the
+// database. Responses given to Eat afterwards are not learned from.
+// Closing again does nothing but return the first error.
+func (d *Dict) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.quit)
+		<-d.done
+		d.closeErr = d.db.Close()
+	})
+	return d.closeErr
+}
@@ -0,0 +1,177 @@
+// Package sample decides which responses the proxies learn from. Learning
+// chunks, hashes and stores every response, which is what costs the most
+// on busy origins: a Sampler keeps a share of them, by URL, and may adapt
+// that share to a time budget.
+//
+// The counters of every Sampler are published with expvar, under
+// "sampling".
+package sample
+
+import (
+	"expvar"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// The budget is spent over windows of that length
+	window = time.Second
+
+	// The adaptive factor never gets lower, so that learning never
+	// completely stops
+	minFactor = 0.001
+)
+
+var (
+	metrics   = expvar.NewMap("sampling")
+	metricsMu sync.Mutex
+)
+
+// A Rule applies Rate to the URLs matching Pattern.
+type Rule struct {
+	Pattern *regexp.Regexp
+	Rate    float64
+}
+
+// A Sampler keeps a share of the responses. The zero value, and a nil
+// Sampler, keep all of them.
+type Sampler struct {
+	// Share of the responses kept when no rule matches
+	rate  float64
+	rules []Rule
+
+	// Time learning may take per window; 0 means no limit
+	budget time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	spent  time.Duration
+	factor float64
+
+	sampled    *expvar.Int
+	skipped    *expvar.Int
+	overBudget *expvar.Int
+	rateVar    *expvar.Float
+}
+
+// New makes a Sampler keeping rate of the responses, or the rate of the
+// first rule matching their URL. With a budget, the rates are lowered
+// while learning takes more than budget per second, and nothing is kept
+// once the budget of the current second is spent. Counters are published
+// under name, and shared with the previous Samplers of that name.
+func New(name string, rate float64, rules []Rule, budget time.Duration) *Sampler {
+	vars := counters(name)
+	s := &Sampler{
+		rate:    rate,
+		rules:   rules,
+		budget:  budget,
+		start:   time.Now(),
+		factor:  1,
+		rateVar: new(expvar.Float),
+	}
+	s.sampled = counter(vars, "sampled")
+	s.skipped = counter(vars, "skipped")
+	s.overBudget = counter(vars, "over_budget")
+	s.rateVar.Set(1)
+	vars.Set("factor", s.rateVar)
+	return s
+}
+
+// counters returns the counters published under name.
+func counters(name string) *expvar.Map {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if vars, ok := metrics.Get(name).(*expvar.Map); ok {
+		return vars
+	}
+	vars := new(expvar.Map).Init()
+	metrics.Set(name, vars)
+	return vars
+}
+
+func counter(vars *expvar.Map, key string) *expvar.Int {
+	if v, ok := vars.Get(key).(*expvar.Int); ok {
+		return v
+	}
+	v := new(expvar.Int)
+	vars.Set(key, v)
+	return v
+}
+
+// Sample is true when the response to url should be learned from.
+func (s *Sampler) Sample(url string) bool {
+	if s == nil || s.sampled == nil {
+		return true
+	}
+
+	rate := s.rate
+	for _, rule := range s.rules {
+		if rule.Pattern.MatchString(url) {
+			rate = rule.Rate
+			break
+		}
+	}
+
+	if s.budget > 0 {
+		s.mu.Lock()
+		s.roll(time.Now())
+		over := s.spent >= s.budget
+		rate *= s.factor
+		s.mu.Unlock()
+		if over {
+			s.overBudget.Add(1)
+			s.skipped.Add(1)
+			return false
+		}
+	}
+
+	if rate < 1 && rand.Float64() >= rate {
+		s.skipped.Add(1)
+		return false
+	}
+	s.sampled.Add(1)
+	return true
+}
+
+// Spent records the time learning from a sampled response took.
+func (s *Sampler) Spent(d time.Duration) {
+	if s == nil || s.budget == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.roll(time.Now())
+	s.spent += d
+	s.mu.Unlock()
+}
+
+// roll starts a new window once the current one is over, and adapts the
+// factor to what the last one spent: down in proportion when over the
+// budget, back up when well under it.
+func (s *Sampler) roll(now time.Time) {
+	elapsed := now.Sub(s.start)
+	if elapsed < window {
+		return
+	}
+
+	// Nothing may have been sampled for a while: what was spent is
+	// spread over the whole time
+	spent := time.Duration(float64(s.spent) * float64(window) / float64(elapsed))
+	switch {
+	case spent > s.budget:
+		s.factor *= float64(s.budget) / float64(spent)
+	case spent < s.budget/2:
+		s.factor *= 2
+	}
+	if s.factor > 1 {
+		s.factor = 1
+	}
+	if s.factor < minFactor {
+		s.factor = minFactor
+	}
+	s.rateVar.Set(s.factor)
+
+	s.start = now
+	s.spent = 0
+}
@@ -0,0 +1,24 @@
+package sdch
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DebugHeader reports which dictionary a response was encoded with.
+const DebugHeader = "X-Sdch-Dictionary"
+
+// AvailDictionaries returns every user agent id listed in the
+// Avail-Dictionary headers of a request, in order.
+func AvailDictionaries(h http.Header) []string {
+	ids := make([]string, 0)
+	for _, line := range h["Avail-Dictionary"] {
+		for _, id := range strings.Split(line, ",") {
+			id = strings.TrimSpace(id)
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,72 @@
+package sdch
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Vary lists the request headers the encoding of a response depends on.
+var Vary = []string{"Accept-Encoding", "Avail-Dictionary"}
+
+// NoTransform is true when the Cache-Control header forbids proxies to
+// change the encoding of the body.
+func NoTransform(h http.Header) bool {
+	for _, line := range h["Cache-Control"] {
+		for _, directive := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddVary adds the headers of Vary to the Vary header of a response that
+// may be sdch-encoded, so that shared caches don't serve it to clients
+// without the dictionary.
+func AddVary(h http.Header) {
+	present := make(map[string]bool)
+	for _, line := range h["Vary"] {
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" {
+				return
+			}
+			present[http.CanonicalHeaderKey(field)] = true
+		}
+	}
+	for _, field := range Vary {
+		if !present[field] {
+			h.Add("Vary", field)
+		}
+	}
+}
+
+// SetEncodedETag changes the ETag of a response encoded with the
+// dictionary of the given server id, then compressed with outer if not
+// empty: it is another representation of the resource, and must not be
+// taken for the original one, nor for the other compressions.
+func SetEncodedETag(h http.Header, serverId, outer string) {
+	etag := h.Get("ETag")
+	if etag == "" {
+		return
+	}
+
+	weak := strings.HasPrefix(etag, "W/")
+	opaque := strings.TrimPrefix(etag, "W/")
+	if len(opaque) < 2 || opaque[0] != '"' || opaque[len(opaque)-1] != '"' {
+		// Not a valid entity tag, don't let it through
+		h.Del("ETag")
+		return
+	}
+
+	suffix := "-sdch-" + serverId
+	if outer != "" {
+		suffix += "-" + outer
+	}
+	etag = `"` + opaque[1:len(opaque)-1] + suffix + `"`
+	if weak {
+		etag = "W/" + etag
+	}
+	h.Set("ETag", etag)
+}
@@ -0,0 +1,153 @@
+// Package sdch holds the parts of the SDCH protocol shared by the
+// proxies and the client.
+package sdch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatVersion = "1.0"
+
+	// Max-Age to use when a dictionary doesn't say
+	DefaultMaxAge = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNoHeaderEnd = errors.New("No end of header in dictionary")
+)
+
+// Header is the header that precedes the content of a dictionary.
+type Header struct {
+	Domain        string
+	Path          string
+	FormatVersion string
+	Ports         []int
+
+	// Zero means DefaultMaxAge
+	MaxAge time.Duration
+}
+
+// ParseDictionary splits a full dictionary into its parsed header, the raw
+// header and the content. The raw header includes the empty line that ends
+// it.
+func ParseDictionary(dict []byte) (h *Header, rawHeader, content []byte, err error) {
+	end := bytes.Index(dict, []byte("\n\n"))
+	if end == -1 {
+		return nil, nil, nil, ErrNoHeaderEnd
+	}
+	rawHeader, content = dict[:end+2], dict[end+2:]
+
+	h, err = ParseHeader(rawHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return h, rawHeader, content, nil
+}
+
+// ParseHeader parses and validates a raw header. Unknown fields are
+// ignored, but every line must be a well-formed field and known fields
+// must appear only once, except Port.
+func ParseHeader(raw []byte) (*Header, error) {
+	h := &Header{}
+	seen := make(map[string]bool)
+
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n\n"), "\n")
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("Malformed header line %q", line)
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+
+		if seen[name] && name != "port" {
+			return nil, fmt.Errorf("Duplicate header field %q", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "domain":
+			h.Domain = value
+		case "path":
+			h.Path = value
+		case "format-version":
+			h.FormatVersion = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Port %q", value)
+			}
+			h.Ports = append(h.Ports, port)
+		case "max-age":
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Max-Age %q", value)
+			}
+			h.MaxAge = time.Duration(secs) * time.Second
+		}
+	}
+
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Validate checks that the header can be used.
+func (h *Header) Validate() error {
+	if h.Domain == "" {
+		return errors.New("Missing Domain")
+	}
+	if strings.ContainsAny(h.Domain, " \t\n/:") {
+		return fmt.Errorf("Invalid Domain %q", h.Domain)
+	}
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("Invalid Path %q", h.Path)
+	}
+	if h.FormatVersion != "" && h.FormatVersion != FormatVersion {
+		return fmt.Errorf("Unsupported Format-Version %q", h.FormatVersion)
+	}
+	for _, port := range h.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("Invalid Port %d", port)
+		}
+	}
+	if h.MaxAge < 0 {
+		return fmt.Errorf("Invalid Max-Age %v", h.MaxAge)
+	}
+	return nil
+}
+
+// Age is the Max-Age of the dictionary, with the default applied.
+func (h *Header) Age() time.Duration {
+	if h.MaxAge == 0 {
+		return DefaultMaxAge
+	}
+	return h.MaxAge
+}
+
+// Bytes serializes the header, including the empty line that ends it.
+func (h *Header) Bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Domain: %s\n", h.Domain)
+	if h.Path != "" {
+		fmt.Fprintf(&buf, "Path: %s\n", h.Path)
+	}
+	if h.FormatVersion != "" {
+		fmt.Fprintf(&buf, "Format-Version: %s\n", h.FormatVersion)
+	}
+	for _, port := range h.Ports {
+		fmt.Fprintf(&buf, "Port: %d\n", port)
+	}
+	if h.MaxAge != 0 {
+		fmt.Fprintf(&buf, "Max-Age: %d\n", int64(h.MaxAge.Seconds()))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
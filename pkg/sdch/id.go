@@ -0,0 +1,37 @@
+package sdch
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Dictionaries are identified as the SDCH spec defines: the SHA-256 is
+// computed over the full dictionary, header included. Its first 48 bits
+// are the user agent id, sent by clients in Avail-Dictionary, and the next
+// 48 bits are the server id, sent by servers in front of encoded
+// responses. Both are encoded with URL-safe base64.
+const idLen = 6
+
+// Hash computes the hash of a dictionary from its raw header and content.
+func Hash(header, content []byte) []byte {
+	h := sha256.New()
+	h.Write(header)
+	h.Write(content)
+	return h.Sum(nil)
+}
+
+// UserAgentId derives the user agent id from a dictionary hash.
+func UserAgentId(hash []byte) string {
+	if len(hash) < 2*idLen {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(hash[:idLen])
+}
+
+// ServerId derives the server id from a dictionary hash.
+func ServerId(hash []byte) string {
+	if len(hash) < 2*idLen {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(hash[idLen : 2*idLen])
+}
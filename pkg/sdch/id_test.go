@@ -0,0 +1,33 @@
+package sdch
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestIds(t *testing.T) {
+	header := []byte("Domain: example.com\nPath: /\n\n")
+	content := []byte("hello, world\n")
+
+	hash := Hash(header, content)
+	if got, want := hex.EncodeToString(hash), "2485ada566d3da0957b64bbe15045afdad5c3fca289afdbcc59c5a999595fbbc"; got != want {
+		t.Fatalf("Hash = %s, want %s", got, want)
+	}
+	if got, want := UserAgentId(hash), "JIWtpWbT"; got != want {
+		t.Errorf("UserAgentId = %q, want %q", got, want)
+	}
+	if got, want := ServerId(hash), "2glXtku-"; got != want {
+		t.Errorf("ServerId = %q, want %q", got, want)
+	}
+}
+
+func TestIdsShortHash(t *testing.T) {
+	for _, hash := range [][]byte{nil, make([]byte, 2*idLen-1)} {
+		if id := UserAgentId(hash); id != "" {
+			t.Errorf("UserAgentId(%x) = %q, want \"\"", hash, id)
+		}
+		if id := ServerId(hash); id != "" {
+			t.Errorf("ServerId(%x) = %q, want \"\"", hash, id)
+		}
+	}
+}
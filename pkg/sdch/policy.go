@@ -0,0 +1,61 @@
+package sdch
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Learnable is true for the responses dictionaries may be learned from:
+// complete, successful responses to GET. Error pages, partial content
+// and empty HEAD bodies would only pollute them.
+func Learnable(req *http.Request, status int) bool {
+	return req.Method == "GET" && status == http.StatusOK && req.Header.Get("Range") == ""
+}
+
+// Encodable is true for the responses that may be sdch-encoded: complete,
+// successful responses to GET, or to HEAD so that it gets the headers the
+// GET would. Ranges apply to the representation the client asked for, so
+// range requests are never encoded.
+func Encodable(req *http.Request, status int) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	return status == http.StatusOK && req.Header.Get("Range") == ""
+}
+
+// Privacy says which personalised responses are not learned from. They
+// may still be encoded: only dictionaries, served to everyone, must not
+// hold anybody's personal data.
+type Privacy struct {
+	// Responses setting a cookie
+	SetCookie bool
+
+	// Responses marked Cache-Control: private or no-store
+	Private bool
+
+	// Responses to requests carrying credentials
+	Authorization bool
+}
+
+// Personal is true when p forbids learning from the response to req with
+// headers h.
+func (p Privacy) Personal(req *http.Request, h http.Header) bool {
+	if p.SetCookie && len(h["Set-Cookie"]) > 0 {
+		return true
+	}
+	if p.Authorization && req.Header.Get("Authorization") != "" {
+		return true
+	}
+	if p.Private {
+		for _, line := range h["Cache-Control"] {
+			for _, directive := range strings.Split(line, ",") {
+				directive = strings.ToLower(strings.TrimSpace(directive))
+				// private may come with a list of fields
+				if directive == "no-store" || directive == "private" || strings.HasPrefix(directive, "private=") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package sdch
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	tests := []struct {
+		method    string
+		rangeHdr  string
+		status    int
+		learnable bool
+		encodable bool
+	}{
+		{"GET", "", http.StatusOK, true, true},
+		{"HEAD", "", http.StatusOK, false, true},
+		{"POST", "", http.StatusOK, false, false},
+		{"GET", "", http.StatusNotFound, false, false},
+		{"GET", "", http.StatusInternalServerError, false, false},
+		{"GET", "", http.StatusNotModified, false, false},
+		{"GET", "bytes=0-99", http.StatusPartialContent, false, false},
+		// A server may ignore Range and send everything: the client
+		// still expects a range of the representation it asked for
+		{"GET", "bytes=0-99", http.StatusOK, false, false},
+		{"HEAD", "bytes=0-99", http.StatusOK, false, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.rangeHdr != "" {
+			req.Header.Set("Range", tt.rangeHdr)
+		}
+		if got := Learnable(req, tt.status); got != tt.learnable {
+			t.Errorf("Learnable(%s, Range %q, %d) = %t, want %t", tt.method, tt.rangeHdr, tt.status, got, tt.learnable)
+		}
+		if got := Encodable(req, tt.status); got != tt.encodable {
+			t.Errorf("Encodable(%s, Range %q, %d) = %t, want %t", tt.method, tt.rangeHdr, tt.status, got, tt.encodable)
+		}
+	}
+}
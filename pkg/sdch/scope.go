@@ -0,0 +1,104 @@
+package sdch
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URLPort is the port of u, or the default one for its scheme.
+func URLPort(u *url.URL) int {
+	if p := u.Port(); p != "" {
+		port, err := strconv.Atoi(p)
+		if err == nil {
+			return port
+		}
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// DomainMatch tells whether host is in domain, with the cookie rules: a
+// domain starting with a dot matches its subdomains, otherwise only the
+// exact host does.
+func DomainMatch(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(domain)
+	if host == domain || "."+host == domain {
+		return true
+	}
+	if strings.HasPrefix(domain, ".") {
+		return strings.HasSuffix(host, domain)
+	}
+	return false
+}
+
+// PathMatch tells whether path is under dictPath. An empty dictPath
+// matches everything.
+func PathMatch(path, dictPath string) bool {
+	if dictPath == "" || dictPath == "/" || path == dictPath {
+		return true
+	}
+	if !strings.HasPrefix(path, dictPath) {
+		return false
+	}
+	return strings.HasSuffix(dictPath, "/") || path[len(dictPath)] == '/'
+}
+
+// CheckReferrer applies the rules a client follows before storing a
+// dictionary announced in a response to referrer.
+func (h *Header) CheckReferrer(referrer *url.URL) error {
+	host := referrer.Hostname()
+	if !DomainMatch(host, h.Domain) {
+		return fmt.Errorf("Domain %q doesn't match %q", h.Domain, host)
+	}
+
+	// No dictionary for a whole top-level domain...
+	domain := strings.TrimPrefix(h.Domain, ".")
+	if strings.HasPrefix(h.Domain, ".") && !strings.Contains(domain, ".") {
+		return fmt.Errorf("Domain %q is a top-level domain", h.Domain)
+	}
+	// ... nor for hosts more than one level below the domain, except
+	// for IP addresses which only match exactly
+	if net.ParseIP(host) == nil && len(host) > len(domain) {
+		prefix := strings.TrimSuffix(host[:len(host)-len(domain)], ".")
+		if strings.Contains(prefix, ".") {
+			return fmt.Errorf("Host %q is too deep in %q", host, h.Domain)
+		}
+	}
+
+	if len(h.Ports) > 0 && !containsPort(h.Ports, URLPort(referrer)) {
+		return fmt.Errorf("Port %d is not in %v", URLPort(referrer), h.Ports)
+	}
+	return nil
+}
+
+// InScope tells whether a dictionary with the given attributes may be
+// advertised for, and used to decode, u. An empty ports list allows any
+// port.
+func InScope(u *url.URL, domain, path string, ports []int) bool {
+	if !DomainMatch(u.Hostname(), domain) {
+		return false
+	}
+	if len(ports) > 0 && !containsPort(ports, URLPort(u)) {
+		return false
+	}
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	return PathMatch(p, path)
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
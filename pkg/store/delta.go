@@ -0,0 +1,61 @@
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+
+	"github.com/rakoo/mmas/pkg/vcdiff"
+)
+
+const (
+	// Sent by clients fetching a dictionary, with the name of the
+	// dictionary they already hold
+	HaveHeader = "X-Sdch-Have-Dictionary"
+
+	// Set on responses carrying a dictionary as a delta, with the name of
+	// the dictionary it was encoded against
+	DeltaBaseHeader = "X-Sdch-Delta-Base"
+)
+
+var (
+	ErrNoGain = errors.New("Delta is not smaller than the dictionary")
+)
+
+// Delta encodes the full dictionary d against the content of the stored
+// dictionary named base, which the client is supposed to hold.
+func (s *Store) Delta(d *Dictionary, base string) ([]byte, error) {
+	baseHash, err := hex.DecodeString(base)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if bytes.Equal(baseHash, d.Hash) {
+		return nil, ErrNoGain
+	}
+	if _, err := s.Entry(baseHash); err != nil {
+		return nil, err
+	}
+
+	full := d.Bytes()
+	delta, err := vcdiff.Delta(s.ContentPath(baseHash), full)
+	if err != nil {
+		return nil, err
+	}
+	if len(delta) >= len(full) {
+		return nil, ErrNoGain
+	}
+	return delta, nil
+}
+
+// Undelta rebuilds a full dictionary from a delta against the content of
+// the stored dictionary named base.
+func (s *Store) Undelta(delta []byte, base string) ([]byte, error) {
+	baseHash, err := hex.DecodeString(base)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if _, err := s.Entry(baseHash); err != nil {
+		return nil, err
+	}
+	return vcdiff.Patch(s.ContentPath(baseHash), delta)
+}
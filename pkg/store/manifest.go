@@ -0,0 +1,48 @@
+package store
+
+import (
+	"time"
+
+	"github.com/rakoo/mmas/pkg/sdch"
+)
+
+// ManifestEntry describes a served dictionary in the JSON manifest that
+// the proxies expose for monitoring and tooling.
+type ManifestEntry struct {
+	Hash        string `json:"hash"`
+	ServerId    string `json:"server_id"`
+	UserAgentId string `json:"user_agent_id"`
+	Domain      string `json:"domain"`
+	Path        string `json:"path"`
+
+	// Size of the content, without the header
+	Size int64 `json:"size"`
+
+	Created time.Time `json:"created"`
+
+	// When clients stop using the dictionary: Max-Age after its
+	// retirement, or after its creation while it is advertised
+	Expires time.Time `json:"expires"`
+
+	Advertised bool `json:"advertised"`
+}
+
+// NewManifestEntry describes a single entry. expires is nil for the
+// advertised dictionary.
+func NewManifestEntry(e Entry, expires *time.Time) ManifestEntry {
+	m := ManifestEntry{
+		Hash:        e.Name(),
+		UserAgentId: sdch.UserAgentId(e.Hash),
+		ServerId:    sdch.ServerId(e.Hash),
+		Domain:      e.Domain,
+		Path:        e.Path,
+		Size:        e.Size,
+		Created:     e.Created,
+		Expires:     e.Expires(),
+		Advertised:  expires == nil,
+	}
+	if expires != nil {
+		m.Expires = *expires
+	}
+	return m
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/rakoo/mmas/pkg/coding"
+)
+
+// ServeDictionary sends d to the client, or a delta against the dictionary
+// it says it has in HaveHeader when that is smaller. Dictionaries never
+// change, so the response is cacheable for as long as the dictionary may
+// be used. The ETag is its hash, followed by "-d<base>" for a delta and
+// by "-<coding>" when compressed: each variant has its own, so that
+// revalidations and ranges apply to the bytes they were made for.
+func (s *Store) ServeDictionary(w http.ResponseWriter, r *http.Request, d *Dictionary) {
+	h := w.Header()
+	h.Set("Content-Type", "application/x-sdch-dictionary")
+	h.Set("Cache-Control", fmt.Sprintf("public, immutable, max-age=%d", int64(d.MaxAge.Seconds())))
+	h.Set("Vary", HaveHeader+", Accept-Encoding")
+
+	etag := d.Name()
+	body := d.Bytes()
+	if base := r.Header.Get(HaveHeader); base != "" {
+		delta, err := s.Delta(d, base)
+		switch err {
+		case nil:
+			log.Printf("Sending dict %s as a %d bytes delta against %s\n", d.Name(), len(delta), base)
+			h.Set(DeltaBaseHeader, base)
+			etag += "-d" + base
+			body = delta
+		case ErrNotFound, ErrNoGain:
+		default:
+			log.Println("Error making dict delta:", err)
+		}
+	}
+
+	body, c := compress(h, r, body)
+	if c != "" {
+		etag += "-" + c
+	}
+	h.Set("ETag", `"`+etag+`"`)
+
+	// Answers If-None-Match with a 304 thanks to the ETag
+	http.ServeContent(w, r, "", d.Created, bytes.NewReader(body))
+}
+
+// compress encodes body with the best coding the client accepts, and
+// sets Content-Encoding accordingly. It returns the coding used, if any.
+func compress(h http.Header, r *http.Request, body []byte) ([]byte, string) {
+	c := coding.Negotiate(r.Header, coding.Preferred...)
+	if c == "" {
+		return body, ""
+	}
+	compressed, err := coding.Encode(body, []string{c})
+	if err != nil {
+		log.Println("Error compressing dict:", err)
+		return body, ""
+	}
+	h.Set("Content-Encoding", c)
+	return compressed, c
+}
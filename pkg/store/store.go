@@ -0,0 +1,372 @@
+// Package store keeps SDCH dictionaries on disk, addressed by the SHA-256
+// of their header and content.
+//
+// Each dictionary is made of three files in the store directory:
+//
+//	<hash>       the content, usable as is by vcdiff
+//	<hash>.hdr   the SDCH header
+//	<hash>.meta  the metadata, written last
+//
+// A dictionary without metadata was not fully stored and is removed when
+// the store is opened.
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/sdch"
+)
+
+const (
+	hdrSuffix  = ".hdr"
+	metaSuffix = ".meta"
+	tmpPrefix  = ".tmp-"
+)
+
+var (
+	ErrNotFound  = errors.New("Dictionary not found")
+	ErrCorrupted = errors.New("Corrupted dictionary")
+)
+
+// Files of the store are named after the hash of their dictionary.
+// Anything else in the directory is left alone.
+var storeFile = regexp.MustCompile(`^[0-9a-f]{64}(\.hdr|\.meta)?$`)
+
+// Meta describes a dictionary.
+type Meta struct {
+	Domain  string
+	Path    string
+	Ports   []int
+	Created time.Time
+	MaxAge  time.Duration
+}
+
+// Entry is a stored dictionary, without its content.
+type Entry struct {
+	Meta
+
+	// SHA-256 of the header followed by the content
+	Hash []byte
+
+	// Size of the content
+	Size int64
+}
+
+// Expires is when clients must stop using the dictionary.
+func (e Entry) Expires() time.Time {
+	return e.Created.Add(e.MaxAge)
+}
+
+// Name is the hex-encoded hash, used as file name and in urls.
+func (e Entry) Name() string {
+	return hex.EncodeToString(e.Hash)
+}
+
+// Dictionary is a stored dictionary with its header and content.
+type Dictionary struct {
+	Entry
+	Header  []byte
+	Content []byte
+}
+
+// Bytes is the full dictionary, as served to clients.
+func (d *Dictionary) Bytes() []byte {
+	full := make([]byte, 0, len(d.Header)+len(d.Content))
+	full = append(full, d.Header...)
+	return append(full, d.Content...)
+}
+
+// On-disk format of the metadata
+type meta struct {
+	Hash    string
+	Domain  string
+	Path    string
+	Ports   []int `json:",omitempty"`
+	Created time.Time
+	MaxAge  int64 // in seconds
+	Size    int64
+}
+
+type Store struct {
+	dir string
+}
+
+// Open opens the store in dir, creating it if needed, and removes any
+// dictionary that was not completely written.
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Dir is the directory the store lives in.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// ContentPath is the path of the content file of the dictionary, to be
+// given to vcdiff.
+func (s *Store) ContentPath(hash []byte) string {
+	return path.Join(s.dir, hex.EncodeToString(hash))
+}
+
+// Put stores a dictionary and returns its entry. Storing the same
+// dictionary twice is not an error.
+func (s *Store) Put(header, content []byte, m Meta) (Entry, error) {
+	e := Entry{
+		Meta: m,
+		Hash: sdch.Hash(header, content),
+		Size: int64(len(content)),
+	}
+	name := e.Name()
+
+	err := writeFileAtomic(path.Join(s.dir, name), content)
+	if err != nil {
+		return Entry{}, err
+	}
+	err = writeFileAtomic(path.Join(s.dir, name+hdrSuffix), header)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	// Metadata comes last: it marks the dictionary as complete
+	data, err := json.Marshal(meta{
+		Hash:    name,
+		Domain:  m.Domain,
+		Path:    m.Path,
+		Ports:   m.Ports,
+		Created: m.Created,
+		MaxAge:  int64(m.MaxAge.Seconds()),
+		Size:    e.Size,
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	err = writeFileAtomic(path.Join(s.dir, name+metaSuffix), data)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return e, nil
+}
+
+// Entry returns the metadata of a dictionary.
+func (s *Store) Entry(hash []byte) (Entry, error) {
+	return s.readMeta(hex.EncodeToString(hash))
+}
+
+// Get returns a dictionary with its header and content.
+func (s *Store) Get(hash []byte) (*Dictionary, error) {
+	e, err := s.Entry(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	name := e.Name()
+	header, err := ioutil.ReadFile(path.Join(s.dir, name+hdrSuffix))
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Dictionary{
+		Entry:   e,
+		Header:  header,
+		Content: content,
+	}, nil
+}
+
+// List returns all the stored dictionaries, newest first.
+func (s *Store) List() ([]Entry, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0)
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), metaSuffix) || !storeFile.MatchString(fi.Name()) {
+			continue
+		}
+		e, err := s.readMeta(strings.TrimSuffix(fi.Name(), metaSuffix))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Sort(byCreatedInv(entries))
+	return entries, nil
+}
+
+// Delete removes a dictionary. Deleting a missing dictionary is not an
+// error.
+func (s *Store) Delete(hash []byte) error {
+	return s.remove(hex.EncodeToString(hash))
+}
+
+func (s *Store) remove(name string) error {
+	// Metadata first, so that an interrupted deletion is finished by
+	// the next Open
+	for _, suffix := range []string{metaSuffix, "", hdrSuffix} {
+		err := os.Remove(path.Join(s.dir, name+suffix))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) readMeta(name string) (Entry, error) {
+	data, err := ioutil.ReadFile(path.Join(s.dir, name+metaSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Entry{}, ErrNotFound
+		}
+		return Entry{}, err
+	}
+
+	var m meta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Entry{}, err
+	}
+	hash, err := hex.DecodeString(m.Hash)
+	if err != nil || m.Hash != name {
+		return Entry{}, ErrCorrupted
+	}
+
+	return Entry{
+		Meta: Meta{
+			Domain:  m.Domain,
+			Path:    m.Path,
+			Ports:   m.Ports,
+			Created: m.Created,
+			MaxAge:  time.Duration(m.MaxAge) * time.Second,
+		},
+		Hash: hash,
+		Size: m.Size,
+	}, nil
+}
+
+// check removes leftovers of interrupted writes: temporary files, and
+// dictionaries whose metadata is missing or doesn't match what is on disk.
+// Files that aren't the store's are kept.
+func (s *Store) check() error {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), tmpPrefix) {
+			log.Println("Removing temporary file", fi.Name())
+			if err := os.Remove(path.Join(s.dir, fi.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if !storeFile.MatchString(fi.Name()) {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(fi.Name(), metaSuffix), hdrSuffix)
+		names[name] = true
+	}
+
+	for name := range names {
+		if err := s.verify(name); err != nil {
+			log.Printf("Removing incomplete dict %s: %s\n", name, err)
+			if err := s.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) verify(name string) error {
+	hash, err := hex.DecodeString(name)
+	if err != nil {
+		return ErrCorrupted
+	}
+	d, err := s.Get(hash)
+	if err != nil {
+		return err
+	}
+	if int64(len(d.Content)) != d.Size {
+		return ErrCorrupted
+	}
+
+	if !bytes.Equal(sdch.Hash(d.Header, d.Content), hash) {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// syncs it and renames it to name, so that name is either absent or
+// complete.
+func writeFileAtomic(name string, data []byte) error {
+	dir, base := path.Split(name)
+	f, err := ioutil.TempFile(dir, tmpPrefix+base)
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	err = func() error {
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmpName, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmpName, name)
+	}()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type byCreatedInv []Entry
+
+func (b byCreatedInv) Len() int           { return len(b) }
+func (b byCreatedInv) Less(i, j int) bool { return b[i].Created.After(b[j].Created) }
+func (b byCreatedInv) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
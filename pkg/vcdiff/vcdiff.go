@@ -0,0 +1,32 @@
+// Package vcdiff runs the open-vcdiff command line tool.
+package vcdiff
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// Delta encodes target against the dictionary file at dictPath.
+func Delta(dictPath string, target []byte) ([]byte, error) {
+	return run(target, "delta", "-dictionary", dictPath, "-interleaved", "-checksum")
+}
+
+// Patch decodes delta with the dictionary file at dictPath.
+func Patch(dictPath string, delta []byte) ([]byte, error) {
+	return run(delta, "patch", "-dictionary", dictPath)
+}
+
+func run(in []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("vcdiff", args...)
+	cmd.Stdin = bytes.NewReader(in)
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("vcdiff %s: %s: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out.Bytes(), nil
+}
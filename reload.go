@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/elazarl/goproxy"
+	"github.com/rakoo/mmas/pkg/config"
+	"github.com/rakoo/mmas/pkg/sample"
+)
+
+// config is the current configuration. It changes on SIGHUP.
+func (bh *bodyHandler) config() *config.Config {
+	bh.confMu.RLock()
+	defer bh.confMu.RUnlock()
+	return bh.conf
+}
+
+// setConfig switches to a new, validated configuration.
+func (bh *bodyHandler) setConfig(conf *config.Config) {
+	hosts := regexp.MustCompile(conf.Proxy.Hosts)
+	sampler := conf.Sampling.Sampler("proxy")
+	bh.confMu.Lock()
+	bh.conf = conf
+	bh.hosts = hosts
+	bh.sampler = sampler
+	bh.confMu.Unlock()
+}
+
+// getSampler picks the responses learned from.
+func (bh *bodyHandler) getSampler() *sample.Sampler {
+	bh.confMu.RLock()
+	defer bh.confMu.RUnlock()
+	return bh.sampler
+}
+
+// forHost is true for responses to hosts the proxy learns from.
+func (bh *bodyHandler) forHost(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	bh.confMu.RLock()
+	defer bh.confMu.RUnlock()
+	return resp != nil && bh.hosts.MatchString(resp.Request.Host)
+}
+
+// encodable is true for responses the proxy learns from and encodes.
+func (bh *bodyHandler) encodable(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	if !bh.forHost(resp, ctx) {
+		return false
+	}
+	return config.MatchContentType(bh.config().Proxy.ContentTypes, resp.Header.Get("Content-Type"))
+}
+
+// learn runs f in the background, unless the proxy is shutting down.
+func (bh *bodyHandler) learn(f func()) {
+	bh.workMu.Lock()
+	defer bh.workMu.Unlock()
+	if bh.closing {
+		return
+	}
+	bh.work.Add(1)
+	go func() {
+		defer bh.work.Done()
+		f()
+	}()
+}
+
+// close waits for the responses being learned from, and for the
+// dictionary being built if any, then closes the database.
+func (bh *bodyHandler) close() error {
+	bh.workMu.Lock()
+	bh.closing = true
+	bh.workMu.Unlock()
+
+	bh.work.Wait()
+	return bh.db.Close()
+}
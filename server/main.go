@@ -2,30 +2,94 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"fmt"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/rakoo/mmas/pkg/admin"
+	"github.com/rakoo/mmas/pkg/coding"
+	"github.com/rakoo/mmas/pkg/config"
 	"github.com/rakoo/mmas/pkg/dict"
+	"github.com/rakoo/mmas/pkg/sample"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
 )
 
+// SDCHProxy fronts one origin, with its own dictionaries. It is not
+// modified once made: a reload makes a new one, that may share the Dict.
 type SDCHProxy struct {
 	proxy  *httputil.ReverseProxy
 	d      *dict.Dict
+	admin  http.Handler
 	target *url.URL
+
+	// What d runs with
+	opts dict.Options
+
+	// Path under which the origin is served, "/" when it is routed by
+	// host
+	prefix string
+
+	// Content types that get sdch-encoded
+	contentTypes []string
+
+	// Responses not learned from
+	privacy sdch.Privacy
+
+	// Picks the responses d learns from, once the proxy is routed to
+	sampler *sample.Sampler
+
+	// Name of the origin
+	name string
 }
 
-func newSDCHProxy(target *url.URL) SDCHProxy {
+// dictOptions is how the Dict of an origin is set up.
+func dictOptions(o config.Origin, conf config.Server, chunks config.Chunks, privacy config.Privacy) dict.Options {
+	domain := o.Host
+	if domain == "" {
+		domain = conf.Domain
+	}
+	dir := path.Join(conf.DataDir, o.Name)
+	ports := []int{config.Port(conf.Listen)}
+	if conf.TLS.Listen != "" {
+		ports = append(ports, config.Port(conf.TLS.Listen))
+	}
+	return dict.Options{
+		Name:            o.Name,
+		DBPath:          path.Join(dir, "dict"),
+		StoreDir:        path.Join(dir, "dicts"),
+		Domain:          domain,
+		Path:            prefix(o),
+		Ports:           ports,
+		MaxAge:          conf.MaxAge.Duration,
+		SplitBits:       chunks.SplitBits,
+		QueueSize:       conf.QueueSize,
+		RebuildInterval: conf.RebuildInterval.Duration,
+		RebuildBatch:    conf.RebuildBatch,
+		MinClients:      privacy.MinClients,
+	}
+}
+
+// newSDCHProxy fronts o. If d is nil, a new Dict is opened with opts.
+func newSDCHProxy(o config.Origin, d *dict.Dict, opts dict.Options, privacy sdch.Privacy, sampler *sample.Sampler, token string) (*SDCHProxy, error) {
+	target, err := url.Parse(o.URL)
+	if err != nil {
+		return nil, err
+	}
 	iproxy := httputil.NewSingleHostReverseProxy(target)
 	pDirector := iproxy.Director
 	iproxy.Director = func(r *http.Request) {
@@ -33,18 +97,38 @@ func newSDCHProxy(target *url.URL) SDCHProxy {
 		r.Host = r.URL.Host
 	}
 
-	d, err := dict.New()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return SDCHProxy{
-		proxy:  iproxy,
-		d:      d,
-		target: target,
+	if d == nil {
+		if err := os.MkdirAll(path.Dir(opts.DBPath), 0755); err != nil {
+			return nil, err
+		}
+		d, err = dict.New(opts)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return &SDCHProxy{
+		proxy:        iproxy,
+		d:            d,
+		admin:        admin.Handler("/_admin/", d, token),
+		target:       target,
+		opts:         opts,
+		prefix:       prefix(o),
+		contentTypes: o.ContentTypes,
+		privacy:      privacy,
+		sampler:      sampler,
+		name:         o.Name,
+	}, nil
 }
 
-func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/_admin/") {
+		s.admin.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/_sdch/manifest.json" {
+		s.serveManifest(w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/_sdch") {
 		s.serveDict(w, r)
 		return
@@ -53,9 +137,8 @@ func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	canSdch := false
 	w.Header().Set("X-Sdch-Encode", "0")
 
-	if len(s.d.SdchHeader) > 0 {
-		path := fmt.Sprintf("/_sdch/%s", s.d.DictName())
-		w.Header().Set("Get-Dictionary", path)
+	if name := s.d.DictName(); name != "" {
+		w.Header().Set("Get-Dictionary", s.prefix+"_sdch/"+name)
 	}
 
 	aes := r.Header["Accept-Encoding"]
@@ -73,49 +156,44 @@ func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// HEAD gets the headers the GET would: the GET is done, and net/http
+	// drops the body
+	upstream := r
+	if r.Method == "HEAD" {
+		upstream = new(http.Request)
+		*upstream = *r
+		upstream.Method = "GET"
+	}
 	rr := httptest.NewRecorder()
-	s.proxy.ServeHTTP(rr, r)
+	s.proxy.ServeHTTP(rr, upstream)
 	copyHeader(w.Header(), rr.Header())
 
-	isTextHtml := false
-	cts := rr.Header()["Content-Type"]
-	for _, ct := range cts {
-		if strings.HasPrefix(ct, "text/html") {
-			isTextHtml = true
-		}
-	}
-
-	if !isTextHtml {
+	if !sdch.Encodable(r, rr.Code) || !s.encodable(rr.Header().Get("Content-Type")) || sdch.NoTransform(rr.Header()) || sdch.NoTransform(r.Header) {
+		w.WriteHeader(rr.Code)
 		io.Copy(w, rr.Body)
 		return
 	}
+	// From now on the response depends on what the client holds
+	sdch.AddVary(w.Header())
 
-	// Read content, ungzip it if needed
+	// Learn from the actual content, whatever the upstream encoding
 	originalContent := rr.Body.Bytes()
-	workContent := originalContent
-
-	ces := rr.Header()["Content-Encoding"]
-	hasGzip := false
-	for _, ce := range ces {
-		if ce == "gzip" {
-			hasGzip = true
-			break
-		}
-	}
-	if hasGzip {
-		gzr, err := gzip.NewReader(rr.Body)
-		if err != nil {
-			httpError(w)
-			return
-		}
-		workContent, err = ioutil.ReadAll(gzr)
-		if err != nil {
-			httpError(w)
-			return
-		}
+	codings := coding.Codings(rr.Header())
+	workContent, err := coding.Decode(originalContent, codings)
+	if err != nil {
+		log.Printf("Not learning from %s (%s): %s\n", r.URL, strings.Join(codings, ", "), err)
+		w.Write(originalContent)
+		return
 	}
 
-	diff, err := s.d.Eat(workContent)
+	// The client may hold several dictionaries, some of them retired
+	hash := s.d.Choose(sdch.AvailDictionaries(r.Header))
+	var diff []byte
+	if sdch.Learnable(r, rr.Code) && !s.privacy.Personal(r, rr.Header()) {
+		diff, err = s.d.Eat(workContent, r, hash)
+	} else {
+		diff, err = s.d.Encode(workContent, hash)
+	}
 	if err != nil {
 		if err != dict.ErrNoDict {
 			log.Println("Error eating:", err)
@@ -125,13 +203,22 @@ func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newContent := originalContent
-	if hasGzip {
-		var buf bytes.Buffer
-		gzw := gzip.NewWriter(&buf)
-		gzw.Write(diff)
-		gzw.Flush()
-		newContent = buf.Bytes()
+	// Whatever the upstream did, compress on top of the sdch encoding,
+	// server id included, as the client prefers
+	serverId := sdch.ServerId(hash)
+	var body bytes.Buffer
+	body.WriteString(serverId)
+	body.WriteByte(0)
+	body.Write(diff)
+	newContent := body.Bytes()
+	outer := coding.Negotiate(r.Header, coding.Preferred...)
+	if outer != "" {
+		newContent, err = coding.Encode(newContent, []string{outer})
+		if err != nil {
+			log.Println("Error encoding:", err)
+			w.Write(originalContent)
+			return
+		}
 	}
 
 	ratio := 100 * float64(len(newContent)) / float64(len(originalContent))
@@ -142,57 +229,50 @@ func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Like Chrome, we only take the first one
-	uaId := r.Header.Get("Avail-Dictionary")
-	if len(uaId) == 0 || uaId != string(s.d.UserAgentId()) {
-		log.Printf("UA wants %s, we have %s\n", uaId, s.d.UserAgentId())
-		w.Write(originalContent)
-		return
-	}
-
 	w.Header().Set("Content-Encoding", "sdch")
-	if hasGzip {
-		w.Header().Add("Content-Encoding", "gzip")
+	if outer != "" {
+		w.Header().Set("Content-Encoding", "sdch, "+outer)
 	}
 	w.Header().Del("X-Sdch-Encode")
+	w.Header().Set(sdch.DebugHeader, hex.EncodeToString(hash))
 
-	serverId := s.d.ServerId()
-	cl := strconv.Itoa(len(serverId) + 1 + len(newContent))
-	w.Header().Set("Content-Length", cl)
-	w.Write(serverId)
-	w.Write([]byte{0})
+	sdch.SetEncodedETag(w.Header(), serverId, outer)
+	w.Header().Set("Content-Length", strconv.Itoa(len(newContent)))
 	w.Write(newContent)
 }
 
-func (s SDCHProxy) serveDict(w http.ResponseWriter, r *http.Request) {
-	var buf bytes.Buffer
-	_, err := buf.Write(s.d.SdchHeader)
-	if err != nil {
-		httpError(w)
-		return
-	}
-
+func (s *SDCHProxy) serveDict(w http.ResponseWriter, r *http.Request) {
 	name := strings.Replace(r.URL.Path, "/_sdch/", "", 1)
-	f, err := os.Open(path.Join("dicts", name))
+	hash, err := hex.DecodeString(name)
 	if err != nil {
-		httpError(w)
+		http.NotFound(w, r)
 		return
 	}
 
-	_, err = io.Copy(&buf, f)
+	d, err := s.d.Store().Get(hash)
 	if err != nil {
-		httpError(w)
+		if err == store.ErrNotFound {
+			http.NotFound(w, r)
+		} else {
+			httpError(w)
+		}
 		return
 	}
 
-	st, err := f.Stat()
+	s.d.Store().ServeDictionary(w, r, d)
+}
+
+func (s *SDCHProxy) serveManifest(w http.ResponseWriter, r *http.Request) {
+	manifest, err := s.d.Manifest()
 	if err != nil {
+		log.Println("Error listing dicts:", err)
 		httpError(w)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/x-sdch-dictionary")
-	http.ServeContent(w, r, "", st.ModTime(), bytes.NewReader(buf.Bytes()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(manifest)
 }
 
 // Same as httputil/reverseproxy.go
@@ -208,13 +288,121 @@ func httpError(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// How long in-flight requests have to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
 func main() {
-	u, err := url.Parse("https://en.wikipedia.org/")
+	var origins originFlags
+	configPath := flag.String("config", "", "configuration file")
+	flag.Var(&origins, "origin", "`host=url` or `/prefix/=url` of an origin to front, may be repeated, replaces the configured ones")
+	listen := flag.String("listen", "", "address to listen on, overrides the configuration")
+	tlsListen := flag.String("tls-listen", "", "address to serve HTTPS on, overrides the configuration")
+	domain := flag.String("domain", "", "dictionary domain of the origins routed by path, overrides the configuration")
+	flag.Parse()
+
+	// Also used on SIGHUP, so that overrides stay in effect
+	loadConfig := func() (*config.Config, error) {
+		conf, err := config.Load(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(origins) > 0 {
+			conf.Server.Origins = append([]config.Origin{}, origins...)
+		}
+		if len(conf.Server.Origins) == 0 {
+			conf.Server.Origins = []config.Origin{{Prefix: "/", URL: "https://en.wikipedia.org/"}}
+		}
+		if *listen != "" {
+			conf.Server.Listen = *listen
+		}
+		if *tlsListen != "" {
+			conf.Server.TLS.Listen = *tlsListen
+		}
+		if *domain != "" {
+			conf.Server.Domain = *domain
+		}
+		return conf, conf.ValidateServer()
+	}
+
+	conf, err := loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	proxy := newSDCHProxy(u)
 
+	token := os.Getenv("MMAS_ADMIN_TOKEN")
+	if token == "" {
+		log.Println("MMAS_ADMIN_TOKEN is not set, admin API is disabled")
+	}
+
+	fe := newFrontend(token)
+	if err := fe.apply(conf); err != nil {
+		log.Fatal(err)
+	}
+
+	servers := []*http.Server{{Addr: conf.Server.Listen, Handler: fe}}
+	var certs *certificates
+	if conf.Server.TLS.Listen != "" {
+		certs = &certificates{}
+		if err := certs.load(conf.Server); err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, &http.Server{
+			Addr:      conf.Server.TLS.Listen,
+			Handler:   fe,
+			TLSConfig: certs.tlsConfig(),
+		})
+		log.Println("Serving HTTPS on", conf.Server.TLS.Listen)
+	}
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(srv)
+	}
 	log.Println("Let's go !")
-	log.Fatal(http.ListenAndServe(":8080", proxy))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Println("Reloading configuration")
+		newConf, err := loadConfig()
+		if err != nil {
+			log.Println("Not reloading:", err)
+			continue
+		}
+		if newConf.Server.Listen != conf.Server.Listen || newConf.Server.TLS.Listen != conf.Server.TLS.Listen {
+			log.Println("Listen addresses only change on restart")
+		}
+		// Certificates first, so that new origins are served with theirs
+		if certs != nil {
+			if err := certs.load(newConf.Server); err != nil {
+				log.Println("Not reloading:", err)
+				continue
+			}
+		}
+		if err := fe.apply(newConf); err != nil {
+			log.Println("Error reloading:", err)
+		}
+	}
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Error shutting down:", err)
+		}
+	}
+	fe.close()
+	log.Println("Bye")
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/config"
+	"github.com/rakoo/mmas/pkg/sample"
+	"github.com/rakoo/mmas/pkg/sdch"
+	"github.com/rakoo/mmas/pkg/store"
+)
+
+const testPage = "<html><body>Hello, this is a page</body></html>"
+
+// fakeVcdiff puts first on the PATH a vcdiff that answers any delta with
+// a few bytes, so that responses get encoded without the real one.
+func fakeVcdiff(t *testing.T, dir string) (restore func()) {
+	script := "#!/bin/sh\ncat >/dev/null\nprintf delta\n"
+	if err := ioutil.WriteFile(path.Join(dir, "vcdiff"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return func() { os.Setenv("PATH", oldPath) }
+}
+
+// newTestProxy fronts upstream with a fresh Dict, learning from all
+// responses, with a published dictionary whose user agent id is uaId;
+// sampled counts the responses it learns from.
+func newTestProxy(t *testing.T, upstream string) (s *SDCHProxy, uaId string, sampled func() int64, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mmas-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := fakeVcdiff(t, dir)
+	conf := config.Default()
+	conf.Server.DataDir = dir
+	o := config.Origin{
+		Name:         t.Name(),
+		Prefix:       "/",
+		URL:          upstream,
+		ContentTypes: []string{"text/html"},
+	}
+	opts := dictOptions(o, conf.Server, conf.Chunks, conf.Privacy)
+	sampler := sample.New(t.Name(), 1, nil, 0)
+	s, err = newSDCHProxy(o, nil, opts, sdch.Privacy{}, sampler, "")
+	if err != nil {
+		restore()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s.d.SetSampler(sampler)
+
+	e, err := s.d.Store().Put([]byte("Domain: localhost\nPath: /\n\n"), []byte(testPage), store.Meta{
+		Domain:  "localhost",
+		Path:    "/",
+		Created: time.Now(),
+		MaxAge:  time.Hour,
+	})
+	if err == nil {
+		err = s.d.Promote(e.Hash)
+	}
+	if err != nil {
+		s.d.Close()
+		restore()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	sampled = func() int64 {
+		vars := expvar.Get("sampling").(*expvar.Map).Get(t.Name()).(*expvar.Map)
+		return vars.Get("sampled").(*expvar.Int).Value()
+	}
+	cleanup = func() {
+		s.d.Close()
+		restore()
+		os.RemoveAll(dir)
+	}
+	return s, sdch.UserAgentId(e.Hash), sampled, cleanup
+}
+
+// encoded is true when the response is sdch-encoded.
+func encoded(h http.Header) bool {
+	return strings.Contains(h.Get("Content-Encoding"), "sdch")
+}
+
+func TestHeadLikeGet(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testPage))
+	}))
+	defer upstream.Close()
+
+	s, uaId, sampled, cleanup := newTestProxy(t, upstream.URL)
+	defer cleanup()
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	do := func(method string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, front.URL+"/page", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "sdch")
+		req.Header.Set("Avail-Dictionary", uaId)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Header.Del("Date")
+		return resp, body
+	}
+
+	head, body := do("HEAD")
+	if len(body) != 0 {
+		t.Errorf("HEAD has a body: %q", body)
+	}
+	if n := sampled(); n != 0 {
+		t.Errorf("Learned from %d HEAD responses", n)
+	}
+
+	get, body := do("GET")
+	if !encoded(get.Header) {
+		t.Errorf("GET is not encoded: %v", get.Header)
+	}
+	if len(body) == 0 || string(body) == testPage {
+		t.Errorf("GET body is %q", body)
+	}
+	if n := sampled(); n != 1 {
+		t.Errorf("Learned from %d GET responses, want 1", n)
+	}
+
+	if head.StatusCode != get.StatusCode {
+		t.Errorf("HEAD status is %d, GET is %d", head.StatusCode, get.StatusCode)
+	}
+	if !reflect.DeepEqual(head.Header, get.Header) {
+		t.Errorf("HEAD headers differ from GET:\n%v\n%v", head.Header, get.Header)
+	}
+}
+
+func TestNotEncodedPassedThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch {
+		case r.Header.Get("Range") != "":
+			w.Header().Set("Content-Range", "bytes 0-19/48")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(testPage[:20]))
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(testPage))
+		default:
+			w.Write([]byte(testPage))
+		}
+	}))
+	defer upstream.Close()
+
+	s, uaId, sampled, cleanup := newTestProxy(t, upstream.URL)
+	defer cleanup()
+
+	for _, c := range []struct {
+		path, rangeHdr string
+		status         int
+		body           string
+	}{
+		{"/missing", "", http.StatusNotFound, testPage},
+		{"/page", "bytes=0-19", http.StatusPartialContent, testPage[:20]},
+	} {
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Header.Set("Accept-Encoding", "sdch")
+		req.Header.Set("Avail-Dictionary", uaId)
+		if c.rangeHdr != "" {
+			req.Header.Set("Range", c.rangeHdr)
+		}
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != c.status {
+			t.Errorf("%s %q: status %d, want %d", c.path, c.rangeHdr, rr.Code, c.status)
+		}
+		if encoded(rr.Header()) {
+			t.Errorf("%s %q: encoded as %q", c.path, c.rangeHdr, rr.Header().Get("Content-Encoding"))
+		}
+		if rr.Body.String() != c.body {
+			t.Errorf("%s %q: body %q, want %q", c.path, c.rangeHdr, rr.Body.String(), c.body)
+		}
+	}
+	if n := sampled(); n != 0 {
+		t.Errorf("Learned from %d responses", n)
+	}
+
+	// The same client gets the complete page encoded
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("Accept-Encoding", "sdch")
+	req.Header.Set("Avail-Dictionary", uaId)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !encoded(rr.Header()) {
+		t.Errorf("Complete page: status %d, Content-Encoding %q", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+	if n := sampled(); n != 1 {
+		t.Errorf("Learned from %d complete pages, want 1", n)
+	}
+}
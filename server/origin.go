@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rakoo/mmas/pkg/config"
+)
+
+// originFlags parses -origin flags, either "host=url" or "/prefix/=url".
+type originFlags []config.Origin
+
+func (of *originFlags) String() string {
+	routes := make([]string, 0, len(*of))
+	for _, o := range *of {
+		routes = append(routes, o.Host+o.Prefix)
+	}
+	return strings.Join(routes, ",")
+}
+
+func (of *originFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return errors.New("origin must be host=url or /prefix/=url")
+	}
+	o := config.Origin{URL: value[i+1:]}
+	if match := value[:i]; strings.HasPrefix(match, "/") {
+		o.Prefix = match
+	} else {
+		o.Host = match
+	}
+	*of = append(*of, o)
+	return nil
+}
+
+// prefix is the path under which an origin is served.
+func prefix(o config.Origin) string {
+	if o.Prefix == "" {
+		return "/"
+	}
+	return o.Prefix
+}
+
+// encodable is true when responses of that content type may be
+// sdch-encoded.
+func (s *SDCHProxy) encodable(contentType string) bool {
+	return config.MatchContentType(s.contentTypes, contentType)
+}
+
+// router sends each request to the origin it is for: by Host first, then
+// by the longest matching path prefix.
+type router struct {
+	byHost   map[string]*SDCHProxy
+	byPrefix []prefixRoute
+}
+
+type prefixRoute struct {
+	prefix string
+	proxy  *SDCHProxy
+}
+
+type byPrefixLenInv []prefixRoute
+
+func (b byPrefixLenInv) Len() int           { return len(b) }
+func (b byPrefixLenInv) Less(i, j int) bool { return len(b[i].prefix) > len(b[j].prefix) }
+func (b byPrefixLenInv) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (rt *router) add(o config.Origin, proxy *SDCHProxy) {
+	if o.Host != "" {
+		if rt.byHost == nil {
+			rt.byHost = make(map[string]*SDCHProxy)
+		}
+		rt.byHost[o.Host] = proxy
+		return
+	}
+	rt.byPrefix = append(rt.byPrefix, prefixRoute{prefix: prefix(o), proxy: proxy})
+	sort.Sort(byPrefixLenInv(rt.byPrefix))
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if proxy, ok := rt.byHost[host]; ok {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	for _, route := range rt.byPrefix {
+		if !strings.HasPrefix(r.URL.Path, route.prefix) {
+			continue
+		}
+		r.URL.Path = "/" + strings.TrimPrefix(r.URL.Path, route.prefix)
+		r.URL.RawPath = ""
+		route.proxy.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/rakoo/mmas/pkg/config"
+)
+
+// frontend routes requests to the origins, and keeps their Dicts across
+// configuration reloads so that nothing learned is lost.
+type frontend struct {
+	token string
+
+	mu      sync.RWMutex
+	rt      *router
+	proxies map[string]*SDCHProxy // by origin name
+}
+
+func newFrontend(token string) *frontend {
+	return &frontend{
+		token:   token,
+		rt:      &router{},
+		proxies: make(map[string]*SDCHProxy),
+	}
+}
+
+func (fe *frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fe.mu.RLock()
+	rt := fe.rt
+	fe.mu.RUnlock()
+	rt.ServeHTTP(w, r)
+}
+
+// apply routes requests as conf says. Origins that were already served
+// keep their Dict, with its options updated; only when the Dict moved to
+// other paths is a new one opened, the old one being closed. Origins that
+// are not configured anymore have their Dict closed. Dicts are only
+// changed or closed once the new ones are all open and routed to, so that
+// a failed reload leaves everything as it was.
+func (fe *frontend) apply(conf *config.Config) error {
+	fe.mu.RLock()
+	old := make(map[string]*SDCHProxy, len(fe.proxies))
+	for name, proxy := range fe.proxies {
+		old[name] = proxy
+	}
+	fe.mu.RUnlock()
+
+	rt := &router{}
+	proxies := make(map[string]*SDCHProxy)
+	var opened, reconfigured, replaced []*SDCHProxy
+	for _, o := range conf.Server.Origins {
+		opts := dictOptions(o, conf.Server, conf.Chunks, conf.Privacy)
+		prev, ok := old[o.Name]
+		// Two Dicts must never share their files
+		reuse := ok && prev.opts.DBPath == opts.DBPath && prev.opts.StoreDir == opts.StoreDir
+		sampler := conf.Sampling.Sampler(o.Name)
+
+		var proxy *SDCHProxy
+		var err error
+		if reuse {
+			proxy, err = newSDCHProxy(o, prev.d, opts, conf.Privacy.Rules(), sampler, fe.token)
+			if err == nil && !reflect.DeepEqual(prev.opts, opts) {
+				if prev.opts.QueueSize != opts.QueueSize {
+					log.Printf("Queue size of %s only changes on restart\n", o.Name)
+				}
+				reconfigured = append(reconfigured, proxy)
+			}
+		} else {
+			if ok {
+				log.Printf("Dictionary of %s moved, reopening it\n", o.Name)
+			}
+			proxy, err = newSDCHProxy(o, nil, opts, conf.Privacy.Rules(), sampler, fe.token)
+			if err == nil {
+				opened = append(opened, proxy)
+				if ok {
+					replaced = append(replaced, prev)
+				}
+			}
+		}
+		if err != nil {
+			for _, p := range opened {
+				p.d.Close()
+			}
+			return err
+		}
+		rt.add(o, proxy)
+		proxies[o.Name] = proxy
+		log.Printf("Fronting %s as %s\n", o.URL, o.Name)
+	}
+
+	fe.mu.Lock()
+	fe.rt = rt
+	fe.proxies = proxies
+	fe.mu.Unlock()
+
+	for _, proxy := range proxies {
+		proxy.d.SetSampler(proxy.sampler)
+	}
+	for _, proxy := range reconfigured {
+		log.Printf("Dictionary options of %s changed\n", proxy.name)
+		proxy.d.SetOptions(proxy.opts)
+	}
+	for _, proxy := range replaced {
+		if err := proxy.d.Close(); err != nil {
+			log.Println("Error closing", proxy.name, err)
+		}
+	}
+	for name, proxy := range old {
+		if _, ok := proxies[name]; !ok {
+			log.Println("Not fronting", name, "anymore")
+			if err := proxy.d.Close(); err != nil {
+				log.Println("Error closing", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// close closes the Dicts of all origins, once requests are not served
+// anymore.
+func (fe *frontend) close() {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	for name, proxy := range fe.proxies {
+		if err := proxy.d.Close(); err != nil {
+			log.Println("Error closing", name, err)
+		}
+	}
+	fe.proxies = make(map[string]*SDCHProxy)
+}
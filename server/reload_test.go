@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/config"
+)
+
+func TestReloadKeepsDictUnderTraffic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "%s %s", testPage, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "mmas-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := config.Default()
+	conf.Server.DataDir = dir
+	conf.Server.RebuildBatch = 1
+	conf.Server.Origins = []config.Origin{{
+		Name:         "origin",
+		Prefix:       "/",
+		URL:          upstream.URL,
+		ContentTypes: []string{"text/html"},
+	}}
+
+	fe := newFrontend("")
+	if err := fe.apply(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer fe.close()
+	before := fe.proxies["origin"].d
+
+	front := httptest.NewServer(fe)
+	defer front.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d/%d", front.URL, i, n), nil)
+				req.Header.Set("Accept-Encoding", "sdch")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("Status %d", resp.StatusCode)
+					return
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	reloaded := *conf
+	reloaded.Chunks.SplitBits = conf.Chunks.SplitBits + 1
+	reloaded.Server.MaxAge.Duration = 2 * conf.Server.MaxAge.Duration
+	if err := fe.apply(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	d := fe.proxies["origin"].d
+	if d != before {
+		t.Fatal("Dict was reopened on the same files")
+	}
+	if fe.proxies["origin"].opts.SplitBits != reloaded.Chunks.SplitBits {
+		t.Error("Options were not updated")
+	}
+	current := d.Current()
+	if current == nil {
+		t.Fatal("No dictionary was published")
+	}
+	if _, err := d.Store().Get(current); err != nil {
+		t.Errorf("Published dictionary %x: %s", current, err)
+	}
+}
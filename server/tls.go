@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/config"
+)
+
+const (
+	selfSignedCert = "self-signed.crt"
+	selfSignedKey  = "self-signed.key"
+
+	// A self-signed certificate is renewed when it expires within that
+	// time
+	selfSignedRenew = 7 * 24 * time.Hour
+)
+
+// certificates picks the certificate of each TLS connection. They are
+// loaded again on reload, as origins and their certificates may change.
+type certificates struct {
+	v atomic.Value // *certSet
+}
+
+type certSet struct {
+	byName map[string]*tls.Certificate
+	def    *tls.Certificate
+}
+
+func (c *certificates) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			set := c.v.Load().(*certSet)
+			if cert, ok := set.byName[strings.ToLower(hello.ServerName)]; ok {
+				return cert, nil
+			}
+			return set.def, nil
+		},
+	}
+}
+
+// load loads the certificates of the origins, picked by SNI, and the
+// default one, used for any other name. Without a configured default
+// certificate, a self-signed one is made for all the names the server
+// answers to. On error, the previous certificates are kept.
+func (c *certificates) load(conf config.Server) error {
+	byName := make(map[string]*tls.Certificate)
+	hosts := []string{"localhost"}
+	if conf.Domain != "localhost" {
+		hosts = append(hosts, conf.Domain)
+	}
+	for _, o := range conf.Origins {
+		if o.Host != "" && o.Host != "localhost" && o.Host != conf.Domain {
+			hosts = append(hosts, o.Host)
+		}
+		if o.Cert == "" {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return err
+		}
+		byName[o.Host] = &cert
+	}
+
+	var def tls.Certificate
+	var err error
+	if conf.TLS.Cert != "" {
+		def, err = tls.LoadX509KeyPair(conf.TLS.Cert, conf.TLS.Key)
+	} else {
+		def, err = selfSigned(path.Join(conf.DataDir, "tls"), hosts)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.v.Store(&certSet{byName: byName, def: &def})
+	return nil
+}
+
+// selfSigned returns the self-signed certificate kept in dir, and makes a
+// new one if there is none, or if it doesn't cover hosts anymore.
+func selfSigned(dir string, hosts []string) (tls.Certificate, error) {
+	certPath := path.Join(dir, selfSignedCert)
+	keyPath := path.Join(dir, selfSignedKey)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && covers(cert, hosts) {
+		return cert, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Replacing self-signed certificate:", err)
+	}
+
+	certPEM, keyPEM, err := makeSelfSigned(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Made a self-signed certificate for %s in %s\n", strings.Join(hosts, ", "), certPath)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// covers is true when cert is valid for a while and for all of hosts.
+func covers(cert tls.Certificate, hosts []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(selfSignedRenew).After(leaf.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func makeSelfSigned(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"mmas"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}